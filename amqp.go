@@ -9,25 +9,66 @@
 package sgul
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/itross/sgul/backoff"
+	"github.com/itross/sgul/tlsconfig"
 	"github.com/streadway/amqp"
 )
 
+// AMQP connection states.
+const (
+	AMQPDisconnected AMQPConnectionState = iota
+	AMQPConnected
+	AMQPReconnecting
+	AMQPClosed
+)
+
+// ErrAMQPConnectionClosed is returned if the AMQP connection has been closed by the application.
+var ErrAMQPConnectionClosed = errors.New("amqp connection closed")
+
+// ErrAMQPReconnectionFailed is returned if the AMQP connection cannot be recovered
+// within the configured reconnection attempts.
+var ErrAMQPReconnectionFailed = errors.New("amqp reconnection failed")
+
 type (
+	// AMQPConnectionState is the state of an AMQP connection.
+	AMQPConnectionState int
+
+	// AMQPStateListener is called on each AMQP connection state change.
+	// The error is the cause of the state change, if any.
+	AMQPStateListener func(state AMQPConnectionState, err error)
+
+	// AMQPReturnListener is called for each message returned by the broker
+	// (a.e. unroutable messages published with the mandatory flag).
+	AMQPReturnListener func(r amqp.Return)
+
 	exchangeInfo struct {
 		exname string
 		extype string
 	}
 	// AMQPConnection is the main struct to manage a connection to an AMQP server.
 	// It keeps exchanges and queues up and register AMQP publishers and subscribers.
+	// If the connection (or its channel) is lost, it reconnects with an exponential backoff
+	// and recovers the whole topology: exchanges, queues, publishers and active subscribers.
+	// The connection Channel is used to declare the topology only: publishers take
+	// channels from a pool and each subscriber consumes on its own dedicated channel.
 	AMQPConnection struct {
 		URI        string
 		Connection *amqp.Connection
 		Channel    *amqp.Channel
+
+		// the AMQP configuration: connection properties and topology
+		conf AMQP
+
 		// keeps information on initialized Exchanges
 		// to be used to initialize Publishers: we need only name and type.
 		exchanges map[string]exchangeInfo
@@ -41,58 +82,358 @@ type (
 
 		// subscribers to start and listen for messages from relative queues
 		Subscribers map[string]*AMQPSubscriber
-	}
-	// AMQPPublisher define the AMQP Publisher structure.
-	// Normally can be used as a sort of repository by a business service.
-	AMQPPublisher struct {
-		Connection   *AMQPConnection
-		Exchange     string
-		ExchangeType string
-		RoutingKey   string
-		ContentType  string
-		DeliveryMode uint8
-	}
 
-	// AMQPSubscriber define the AMQP Subscriber structure.
-	// TODO: complete the definition!!!
-	AMQPSubscriber struct {
-		Connection *AMQPConnection
-		Queue      string
-		Consumer   string
-		AutoAck    bool
-		Exclusive  bool
-		NoLocal    bool
-		NoWait     bool
-		Replies    <-chan amqp.Delivery
+		// pool of channels for concurrent publishing
+		pool *amqpChannelPool
+
+		// channel in confirm mode to republish (retry and dead-letter) consumed messages
+		confirm *amqpConfirmChannel
+
+		// request/reply client
+		rpc *amqpRPCClient
+
+		// event handlers registered by subscriber name
+		handlers map[string]EventHandler
+
+		// mu guards the connection, channel, state, listeners and the exchanges, queues,
+		// publishers, subscribers and handlers maps (rewritten by the topology setup on reconnection)
+
+		mu        *sync.RWMutex
+		state     AMQPConnectionState
+		listeners []AMQPStateListener
+		returns   []AMQPReturnListener
+		closed    chan struct{}
+		closeOnce *sync.Once
+
+		// reconnection policy
+		backoff     backoff.Policy
+		maxAttempts int
 	}
 )
 
-var amqpConf = GetConfiguration().AMQP
-
-// NewAMQPConnection return a new disconnected AMQP Connection structure.
-func NewAMQPConnection() *AMQPConnection {
-	URI := fmt.Sprintf("amqp://%s:%s@%s:%d/%s", amqpConf.User, amqpConf.Password, amqpConf.Host, amqpConf.Port, amqpConf.VHost)
-	return &AMQPConnection{
+// NewAMQPConnection return a new disconnected AMQP Connection structure
+// configured with the conf AMQP configuration.
+func NewAMQPConnection(conf AMQP) *AMQPConnection {
+	scheme, port := "amqp", 5672
+	if conf.TLS.Enabled {
+		scheme, port = "amqps", 5671
+	}
+	if conf.Port > 0 {
+		port = conf.Port
+	}
+	// user, password and vhost are escaped: the default vhost is "/"
+	URI := (&url.URL{
+		Scheme:  scheme,
+		User:    url.UserPassword(conf.User, conf.Password),
+		Host:    net.JoinHostPort(conf.Host, strconv.Itoa(port)),
+		Path:    "/" + conf.VHost,
+		RawPath: "/" + url.PathEscape(conf.VHost),
+	}).String()
+
+	conn := &AMQPConnection{
 		URI:         URI,
+		conf:        conf,
 		exchanges:   make(map[string]exchangeInfo),
 		queues:      make(map[string]amqp.Queue),
 		Publishers:  make(map[string]*AMQPPublisher),
 		Subscribers: make(map[string]*AMQPSubscriber),
+		handlers:    make(map[string]EventHandler),
+		mu:          &sync.RWMutex{},
+		state:       AMQPDisconnected,
+		closed:      make(chan struct{}),
+		closeOnce:   &sync.Once{},
+		backoff:     reconnectBackoff(conf),
+		maxAttempts: conf.Reconnect.MaxAttempts,
 	}
+	conn.pool = newAMQPChannelPool(conn, conf.ChannelPoolSize)
+	conn.confirm = newAMQPConfirmChannel(conn)
+	conn.rpc = newAMQPRPCClient(conn)
+	return conn
+}
+
+// NewAMQPConnectionFromConfig return a new disconnected AMQP Connection structure
+// configured with the application AMQP configuration.
+func NewAMQPConnectionFromConfig() *AMQPConnection {
+	return NewAMQPConnection(GetConfiguration().AMQP)
+}
+
+// Config returns the AMQP configuration of the connection.
+func (conn *AMQPConnection) Config() AMQP {
+	return conn.conf
+}
+
+// dial opens a new connection to the AMQP server with the configured
+// connection properties: TLS, heartbeat and connection name.
+func (conn *AMQPConnection) dial() (*amqp.Connection, error) {
+	config := amqp.Config{Heartbeat: conn.conf.Heartbeat}
+
+	if conn.conf.TLS.Enabled {
+		tlsConf := conn.conf.TLS
+		tlsConfig, err := tlsconfig.New(tlsConf.CertFile, tlsConf.KeyFile, tlsConf.CAFile, tlsConf.InsecureSkipVerify)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ServerName = tlsConf.ServerName
+		config.TLSClientConfig = tlsConfig
+	}
+
+	if conn.conf.ConnectionName != "" {
+		config.Properties = amqp.Table{"connection_name": conn.conf.ConnectionName}
+	}
+
+	return amqp.DialConfig(conn.URI, config)
+}
+
+// reconnectBackoff returns the configured reconnection backoff policy:
+// unset values are taken from the default one.
+func reconnectBackoff(conf AMQP) backoff.Policy {
+	return backoff.Policy{
+		InitialInterval: conf.Reconnect.InitialInterval,
+		MaxInterval:     conf.Reconnect.MaxInterval,
+		Multiplier:      conf.Reconnect.Multiplier,
+		Jitter:          conf.Reconnect.Jitter,
+		NoJitter:        conf.Reconnect.NoJitter,
+	}.Merge(backoff.Default)
+}
+
+// String returns the AMQP connection state name.
+func (s AMQPConnectionState) String() string {
+	switch s {
+	case AMQPDisconnected:
+		return "disconnected"
+	case AMQPConnected:
+		return "connected"
+	case AMQPReconnecting:
+		return "reconnecting"
+	case AMQPClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// OnStateChange registers a listener for the connection state changes.
+func (conn *AMQPConnection) OnStateChange(listener AMQPStateListener) {
+	conn.mu.Lock()
+	conn.listeners = append(conn.listeners, listener)
+	conn.mu.Unlock()
+}
+
+// OnReturn registers a listener for the messages returned by the broker.
+func (conn *AMQPConnection) OnReturn(listener AMQPReturnListener) {
+	conn.mu.Lock()
+	conn.returns = append(conn.returns, listener)
+	conn.mu.Unlock()
+}
+
+// handleReturns passes each returned message to the return listeners,
+// till the channel is closed.
+func (conn *AMQPConnection) handleReturns(returns chan amqp.Return) {
+	for r := range returns {
+		conn.mu.RLock()
+		listeners := conn.returns
+		conn.mu.RUnlock()
+
+		if len(listeners) == 0 {
+			log.Printf("amqp message %s returned from exchange %s with routing key %s: %s",
+				r.MessageId, r.Exchange, r.RoutingKey, r.ReplyText)
+		}
+		for _, listener := range listeners {
+			listener(r)
+		}
+	}
+}
+
+// State returns the current connection state.
+func (conn *AMQPConnection) State() AMQPConnectionState {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+	return conn.state
+}
+
+func (conn *AMQPConnection) setState(state AMQPConnectionState, err error) {
+	conn.mu.Lock()
+	conn.state = state
+	listeners := conn.listeners
+	conn.mu.Unlock()
+
+	for _, listener := range listeners {
+		listener(state, err)
+	}
+}
+
+// channel returns the current AMQP channel (it changes on reconnection).
+func (conn *AMQPConnection) channel() *amqp.Channel {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+	return conn.Channel
+}
+
+// exchange returns the declared "name"-exchange information.
+func (conn *AMQPConnection) exchange(name string) (exchangeInfo, bool) {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+	ei, ok := conn.exchanges[name]
+	return ei, ok
+}
+
+// publisher returns the registered "name"-publisher, or nil.
+func (conn *AMQPConnection) publisher(name string) *AMQPPublisher {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+	return conn.Publishers[name]
+}
+
+// subscriber returns the registered "name"-subscriber, or nil.
+func (conn *AMQPConnection) subscriber(name string) *AMQPSubscriber {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+	return conn.Subscribers[name]
+}
+
+// subscribers returns the registered subscribers.
+func (conn *AMQPConnection) subscribers() []*AMQPSubscriber {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+	subscribers := make([]*AMQPSubscriber, 0, len(conn.Subscribers))
+	for _, sub := range conn.Subscribers {
+		subscribers = append(subscribers, sub)
+	}
+	return subscribers
+}
+
+// handler returns the event handler registered for the "name"-subscriber, or nil.
+func (conn *AMQPConnection) handler(name string) EventHandler {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+	return conn.handlers[strings.ToLower(name)]
 }
 
 // Connect open an AMQP connection and setup the channel.
+// The AMQP configuration is validated first: an *AMQPConfigError is returned if it is not valid.
+// In dry-run mode (AMQP.DryRun) the topology report is logged and ErrAMQPDryRun is returned.
+// Once connected, the connection is watched and recovered if lost.
 func (conn *AMQPConnection) Connect() error {
-	var err error
-
-	if conn.Connection, err = amqp.Dial(conn.URI); err != nil {
+	if err := ValidateAMQPConfig(conn.conf); err != nil {
 		return err
 	}
 
-	if conn.Channel, err = conn.Connection.Channel(); err != nil {
+	if conn.conf.DryRun {
+		report, err := conn.DryRun()
+		if err != nil {
+			return err
+		}
+		log.Printf("amqp dry-run topology report:\n%s", report)
+		return ErrAMQPDryRun
+	}
+
+	connErrors, chanErrors, err := conn.connect()
+	if err != nil {
 		return err
 	}
 
+	go conn.watch(connErrors, chanErrors)
+	return nil
+}
+
+// connect dials the AMQP server (if not already connected), opens the channel
+// and declares the whole topology. It returns the close notification channels
+// for the connection and the channel.
+func (conn *AMQPConnection) connect() (chan *amqp.Error, chan *amqp.Error, error) {
+	var err error
+
+	conn.mu.RLock()
+	connection := conn.Connection
+	conn.mu.RUnlock()
+
+	if connection == nil || connection.IsClosed() {
+		if connection, err = conn.dial(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	channel, err := connection.Channel()
+	if err != nil {
+		connection.Close()
+		return nil, nil, err
+	}
+
+	conn.mu.Lock()
+	conn.Connection = connection
+	conn.Channel = channel
+	conn.mu.Unlock()
+
+	connErrors := connection.NotifyClose(make(chan *amqp.Error, 1))
+	chanErrors := channel.NotifyClose(make(chan *amqp.Error, 1))
+	go conn.handleReturns(channel.NotifyReturn(make(chan amqp.Return, 1)))
+
+	if err = conn.setup(); err != nil {
+		channel.Close()
+		return nil, nil, err
+	}
+
+	conn.setState(AMQPConnected, nil)
+	return connErrors, chanErrors, nil
+}
+
+// watch waits for connection or channel close notifications and recovers the
+// connection, unless it has been closed by the application.
+func (conn *AMQPConnection) watch(connErrors chan *amqp.Error, chanErrors chan *amqp.Error) {
+	for {
+		var amqpErr *amqp.Error
+		select {
+		case amqpErr = <-connErrors:
+		case amqpErr = <-chanErrors:
+		case <-conn.closed:
+			return
+		}
+
+		select {
+		case <-conn.closed:
+			return
+		default:
+		}
+
+		var cause error
+		if amqpErr != nil {
+			cause = amqpErr
+		}
+		log.Printf("amqp connection lost: %v", cause)
+		conn.setState(AMQPReconnecting, cause)
+
+		var err error
+		if connErrors, chanErrors, err = conn.reconnect(); err != nil {
+			log.Printf("amqp connection not recovered: %s", err)
+			conn.setState(AMQPClosed, err)
+			return
+		}
+		log.Print("amqp connection recovered")
+	}
+}
+
+// reconnect tries and reconnect till success, the maximum number of attempts or
+// the connection close by the application.
+func (conn *AMQPConnection) reconnect() (chan *amqp.Error, chan *amqp.Error, error) {
+	for attempt := 1; conn.maxAttempts <= 0 || attempt <= conn.maxAttempts; attempt++ {
+		select {
+		case <-conn.closed:
+			return nil, nil, ErrAMQPConnectionClosed
+		case <-time.After(conn.backoff.Duration(attempt)):
+		}
+
+		connErrors, chanErrors, err := conn.connect()
+		if err == nil {
+			return connErrors, chanErrors, nil
+		}
+		log.Printf("amqp reconnection attempt %d failed: %s", attempt, err)
+	}
+	return nil, nil, ErrAMQPReconnectionFailed
+}
+
+// setup declares the whole AMQP topology.
+func (conn *AMQPConnection) setup() error {
+	var err error
+
 	if err = conn.declareExchanges(); err != nil {
 		return err
 	}
@@ -101,24 +442,41 @@ func (conn *AMQPConnection) Connect() error {
 		return err
 	}
 
+	if err = conn.declareBindings(); err != nil {
+		return err
+	}
+
 	if err = conn.initPublishers(); err != nil {
 		return err
 	}
 
+	if err = conn.initSubscribers(); err != nil {
+		return err
+	}
+
+	if err = conn.declareRetryQueues(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
 // declareExchanges will setup each of the configured Exchanges
 func (conn *AMQPConnection) declareExchanges() error {
-	for _, exchange := range amqpConf.Exchanges {
-		err := conn.Channel.ExchangeDeclare(
+	for _, exchange := range conn.conf.Exchanges {
+		args, err := exchangeArgs(exchange)
+		if err != nil {
+			return err
+		}
+
+		err = conn.channel().ExchangeDeclare(
 			exchange.Name,
 			exchange.Type,
 			exchange.Durable,
 			exchange.AutoDelete,
 			exchange.Internal,
 			exchange.NoWait,
-			nil)
+			args)
 
 		if err != nil {
 			return err
@@ -129,20 +487,27 @@ func (conn *AMQPConnection) declareExchanges() error {
 			exname: exchange.Name,
 			extype: exchange.Type,
 		}
+		conn.mu.Lock()
 		conn.exchanges[ei.exname] = ei
+		conn.mu.Unlock()
 	}
 	return nil
 }
 
 func (conn *AMQPConnection) declareQueues() error {
-	for _, queue := range amqpConf.Queues {
-		q, err := conn.Channel.QueueDeclare(
+	for _, queue := range conn.conf.Queues {
+		args, err := queueArgs(queue)
+		if err != nil {
+			return err
+		}
+
+		q, err := conn.channel().QueueDeclare(
 			queue.Name,
 			queue.Durable,
 			queue.AutoDelete,
 			queue.Exclusive,
 			queue.NoWait,
-			nil,
+			args,
 		)
 
 		if err != nil {
@@ -150,213 +515,66 @@ func (conn *AMQPConnection) declareQueues() error {
 		}
 
 		// add the queue into the queues map
+		conn.mu.Lock()
 		conn.queues[q.Name] = q
+		conn.mu.Unlock()
 	}
 	return nil
 }
 
-func (conn *AMQPConnection) initPublishers() error {
-	for _, p := range amqpConf.Publishers {
-		if conn.Publishers[p.Name] == nil {
-			publisher, err := conn.NewPublisher(p.Name)
+// declareBindings binds each of the configured queues or destination exchanges to their exchange.
+func (conn *AMQPConnection) declareBindings() error {
+	for _, binding := range conn.conf.Bindings {
+		if binding.Queue == "" && binding.Destination == "" {
+			return fmt.Errorf("binding to exchange '%s' has no queue nor destination exchange", binding.Exchange)
+		}
+
+		args, err := amqpTable(binding.Args)
+		if err != nil {
+			return fmt.Errorf("binding to exchange '%s': %s", binding.Exchange, err)
+		}
+
+		routingKeys := binding.RoutingKeys
+		if len(routingKeys) == 0 {
+			routingKeys = []string{""}
+		}
+
+		for _, key := range routingKeys {
+			if binding.Queue != "" {
+				err = conn.channel().QueueBind(binding.Queue, key, binding.Exchange, binding.NoWait, args)
+			} else {
+				err = conn.channel().ExchangeBind(binding.Destination, key, binding.Exchange, binding.NoWait, args)
+			}
+
 			if err != nil {
 				return err
 			}
-			conn.Publishers[p.Name] = publisher
 		}
-
 	}
 	return nil
 }
 
 // Close closes AMQP channel and connection.
+// A closed connection will not be recovered anymore.
 func (conn *AMQPConnection) Close() error {
-	if err := conn.Channel.Close(); err != nil {
-		return err
-	}
-	if err := conn.Connection.Close(); err != nil {
-		return err
-	}
-	return nil
-}
-
-// // Publisher returns a new AMQP Publisher on this connection.
-// func (conn *AMQPConnection) Publisher(exchange string, exchangeType string, routingKey string) (*AMQPPublisher, error) {
-// 	return NewAMQPPublisher(conn, exchange, exchangeType, routingKey)
-// }
-
-// Subscriber reutrns a new AMQP Subscriber on this connection.
-func (conn *AMQPConnection) Subscriber(queue string, consumer string, durable, autoDelete, autoAck, exclusive, noLocal, noWait bool) (*AMQPSubscriber, error) {
-	return NewAMQPSubscriber(conn, queue, consumer, durable, autoDelete, autoAck, exclusive, noLocal, noWait)
-}
-
-// NewAMQPPublisher return a new AMQP Publisher object.
-func NewAMQPPublisher(connection *AMQPConnection, exchange string, exchangeType string, routingKey string) (*AMQPPublisher, error) {
-	if err := connection.Channel.ExchangeDeclare(
-		exchange, exchangeType,
-		true, false, false, false, nil); err != nil {
-		return nil, err
-	}
-
-	return &AMQPPublisher{
-		Connection:   connection,
-		Exchange:     exchange,
-		ExchangeType: exchangeType,
-		RoutingKey:   routingKey,
-	}, nil
-}
-
-// NewPublisher return a new AMQP Publisher object initialized with "name"-publisher configuration.
-func (conn *AMQPConnection) NewPublisher(name string) (*AMQPPublisher, error) {
-	if conn.Publishers[name] != nil {
-		return conn.Publishers[name], nil
-	}
-
-	// get publisher configuration
-	p, ok := publisherFor(name)
-
-	if !ok {
-		return nil, fmt.Errorf("no configuration fond for publisher '%s'", name)
-	}
-
-	// initialize and register the AMQP Publisher struct
-	ei := conn.exchanges[p.Exchange]
-	publisher := &AMQPPublisher{
-		Connection:   conn,
-		Exchange:     ei.exname,
-		ExchangeType: ei.extype,
-		RoutingKey:   p.RoutingKey,
-		ContentType:  p.ContentType,
-		DeliveryMode: p.DeliveryMode,
-	}
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+	})
+	defer conn.setState(AMQPClosed, nil)
 
-	// conn.publishers[p.Name] = publisher
-
-	return publisher, nil
-
-	// if p, ok := publisherFor(name); ok {
-	// 	ei := conn.exchanges[p.Exchange]
-	// 	publisher := &AMQPPublisher{
-	// 		Connection:   conn,
-	// 		Exchange:     ei.exname,
-	// 		ExchangeType: ei.extype,
-	// 		RoutingKey:   p.RoutingKey,
-	// 		ContentType:  p.ContentType,
-	// 		DeliveryMode: p.DeliveryMode,
-	// 	}
-
-	// 	conn.publishers[p.Name] = publisher
-
-	// 	return publisher, nil
-
-	// 	// if exchange, ok := exchangeFor(publisher.Name); ok {
-	// 	// 	err := conn.Channel.ExchangeDeclare(
-	// 	// 		exchange.Name,
-	// 	// 		exchange.Type,
-	// 	// 		exchange.Durable,
-	// 	// 		exchange.AutoDelete,
-	// 	// 		exchange.Internal,
-	// 	// 		exchange.NoWait,
-	// 	// 		nil)
-
-	// 	// 	if err != nil {
-	// 	// 		return nil, err
-	// 	// 	}
-
-	// 	// 	return &AMQPPublisher{
-	// 	// 		Connection:   conn,
-	// 	// 		Exchange:     exchange.Name,
-	// 	// 		ExchangeType: exchange.Type,
-	// 	// 		RoutingKey:   publisher.RoutingKey,
-	// 	// 		ContentType:  publisher.ContentType,
-	// 	// 		DeliveryMode: publisher.DeliveryMode,
-	// 	// 	}, nil
-	// 	// }
-	// }
-
-	// return nil, nil
-}
+	conn.mu.RLock()
+	channel, connection := conn.Channel, conn.Connection
+	conn.mu.RUnlock()
 
-func publisherFor(name string) (Publisher, bool) {
-	for _, publisher := range amqpConf.Publishers {
-		if strings.ToLower(publisher.Name) == strings.ToLower(name) {
-			return publisher, true
+	if channel != nil {
+		if err := channel.Close(); err != nil && err != amqp.ErrClosed {
+			return err
 		}
 	}
-
-	// no publisher configuration found for "name"
-	return Publisher{}, false
-}
-
-func exchangeFor(name string) (Exchange, bool) {
-	for _, exchange := range amqpConf.Exchanges {
-		if exchange.Name == name {
-			return exchange, true
+	if connection != nil {
+		if err := connection.Close(); err != nil && err != amqp.ErrClosed {
+			return err
 		}
 	}
-
-	// no exchange configuration found for "name"
-	return Exchange{}, false
-}
-
-// Publish send a message to the AMQP Exchange.
-// TODO: try and parametrize even "mandatory" and "immdiate" flags.
-func (pub *AMQPPublisher) Publish(event Event) error {
-	payload, err := json.Marshal(event)
-	if err != nil {
-		return err
-	}
-
-	err = pub.Connection.Channel.Publish(
-		pub.Exchange,
-		pub.RoutingKey,
-		false,
-		false,
-		amqp.Publishing{
-			DeliveryMode: pub.DeliveryMode,
-			ContentType:  pub.ContentType,
-			Body:         payload,
-			Timestamp:    time.Now(),
-		})
-
-	return err
-}
-
-// NewAMQPSubscriber returns a new AMQP Subscriber object.
-func NewAMQPSubscriber(connection *AMQPConnection, queue string, consumer string, durable, autoDelete, autoAck, exclusive, noLocal, noWait bool) (*AMQPSubscriber, error) {
-	q, err := connection.Channel.QueueDeclare(
-		queue,
-		durable,
-		autoDelete,
-		exclusive,
-		noWait,
-		nil,
-	)
-
-	if err != nil {
-		return nil, err
-	}
-
-	return &AMQPSubscriber{
-		Connection: connection,
-		Queue:      q.Name,
-		Consumer:   consumer,
-		AutoAck:    autoAck,
-		Exclusive:  exclusive,
-		NoLocal:    noLocal,
-		NoWait:     noWait,
-	}, nil
-}
-
-// Consume start consuming messages from queue. Returns outputs channel to range on.
-func (sub *AMQPSubscriber) Consume() (<-chan amqp.Delivery, error) {
-	return sub.Connection.Channel.Consume(
-		sub.Queue,
-		sub.Consumer,
-		sub.AutoAck,
-		sub.Exclusive,
-		sub.NoLocal,
-		sub.NoWait,
-		nil,
-	)
+	return nil
 }
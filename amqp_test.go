@@ -0,0 +1,241 @@
+// Copyright 2019 Luca Stasio <joshuagame@gmail.com>
+// Copyright 2019 IT Resources s.r.l.
+//
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package sgul
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// fakeAMQPBroker is a minimal AMQP 0-9-1 server: it accepts connections and channels and
+// confirms any topology declaration, without routing messages.
+type fakeAMQPBroker struct {
+	listener net.Listener
+	mu       sync.Mutex
+	conns    []net.Conn
+}
+
+// newFakeAMQPBroker starts a fake broker listening on a random local port.
+func newFakeAMQPBroker(t *testing.T) *fakeAMQPBroker {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeAMQPBroker{listener: listener}
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			b.mu.Lock()
+			b.conns = append(b.conns, c)
+			b.mu.Unlock()
+			go b.serve(c)
+		}
+	}()
+	return b
+}
+
+// config returns an AMQP configuration connecting to the broker and recovering connections at once.
+func (b *fakeAMQPBroker) config() AMQP {
+	host, port, _ := net.SplitHostPort(b.listener.Addr().String())
+	var conf AMQP
+	conf.Host = host
+	conf.Port, _ = strconv.Atoi(port)
+	conf.Reconnect.InitialInterval = time.Millisecond
+	conf.Reconnect.MaxInterval = 5 * time.Millisecond
+	conf.Reconnect.NoJitter = true
+	return conf
+}
+
+// dropConnections closes all the client connections, as a broker restart.
+func (b *fakeAMQPBroker) dropConnections() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, c := range b.conns {
+		c.Close()
+	}
+	b.conns = nil
+}
+
+// Close stops the broker.
+func (b *fakeAMQPBroker) Close() {
+	b.listener.Close()
+	b.dropConnections()
+}
+
+func (b *fakeAMQPBroker) serve(c net.Conn) {
+	defer c.Close()
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(c, header); err != nil {
+		return
+	}
+	// connection.start: version 0-9, no server properties, PLAIN mechanism, en_US locale
+	start := append([]byte{0, 9, 0, 0, 0, 0}, append(fakeLongString("PLAIN"), fakeLongString("en_US")...)...)
+	fakeWriteMethod(c, 0, 10, 10, start)
+
+	for {
+		frameHeader := make([]byte, 7)
+		if _, err := io.ReadFull(c, frameHeader); err != nil {
+			return
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(frameHeader[3:])+1)
+		if _, err := io.ReadFull(c, payload); err != nil {
+			return
+		}
+		if frameHeader[0] != 1 {
+			// heartbeat and content frames
+			continue
+		}
+
+		channel := binary.BigEndian.Uint16(frameHeader[1:])
+		class, method := binary.BigEndian.Uint16(payload), binary.BigEndian.Uint16(payload[2:])
+		switch {
+		case class == 10 && method == 11: // connection.start-ok: tune
+			fakeWriteMethod(c, 0, 10, 30, []byte{0, 0, 0, 2, 0, 0, 0, 0})
+		case class == 10 && method == 40: // connection.open
+			fakeWriteMethod(c, 0, 10, 41, []byte{0})
+		case class == 10 && method == 50: // connection.close
+			fakeWriteMethod(c, 0, 10, 51, nil)
+			return
+		case class == 20 && method == 10: // channel.open
+			fakeWriteMethod(c, channel, 20, 11, fakeLongString(""))
+		case class == 20 && method == 40: // channel.close
+			fakeWriteMethod(c, channel, 20, 41, nil)
+		case class == 40 && (method == 10 || method == 30): // exchange.declare and exchange.bind
+			fakeWriteMethod(c, channel, 40, method+1, nil)
+		case class == 50 && method == 10: // queue.declare
+			name := string(payload[7 : 7+int(payload[6])])
+			fakeWriteMethod(c, channel, 50, 11, append(append([]byte{byte(len(name))}, name...), 0, 0, 0, 0, 0, 0, 0, 0))
+		case class == 50 && method == 20, class == 60 && method == 10, class == 85 && method == 10: // queue.bind, basic.qos, confirm.select
+			fakeWriteMethod(c, channel, class, method+1, nil)
+		}
+	}
+}
+
+func fakeLongString(s string) []byte {
+	b := make([]byte, 4, 4+len(s))
+	binary.BigEndian.PutUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+func fakeWriteMethod(w io.Writer, channel uint16, class uint16, method uint16, args []byte) {
+	var frame bytes.Buffer
+	frame.WriteByte(1)
+	binary.Write(&frame, binary.BigEndian, channel)
+	binary.Write(&frame, binary.BigEndian, uint32(4+len(args)))
+	binary.Write(&frame, binary.BigEndian, class)
+	binary.Write(&frame, binary.BigEndian, method)
+	frame.Write(args)
+	frame.WriteByte(0xCE)
+	w.Write(frame.Bytes())
+}
+
+func TestNewAMQPConnectionURI(t *testing.T) {
+	tests := []struct {
+		name  string
+		vhost string
+		want  string
+	}{
+		{"default vhost", "/", "/"},
+		{"no vhost", "", "/"},
+		{"named vhost", "orders", "orders"},
+		{"vhost with slash", "/orders", "/orders"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var conf AMQP
+			conf.User = "sgul@itross"
+			conf.Password = "p@ss:w/rd?#%"
+			conf.Host = "localhost"
+			conf.VHost = tt.vhost
+
+			uri, err := amqp.ParseURI(NewAMQPConnection(conf).URI)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if uri.Username != conf.User || uri.Password != conf.Password {
+				t.Errorf("credentials = %s:%s, want %s:%s", uri.Username, uri.Password, conf.User, conf.Password)
+			}
+			if uri.Host != conf.Host || uri.Port != 5672 {
+				t.Errorf("address = %s:%d, want %s:5672", uri.Host, uri.Port, conf.Host)
+			}
+			if uri.Vhost != tt.want {
+				t.Errorf("vhost = %q, want %q", uri.Vhost, tt.want)
+			}
+		})
+	}
+}
+
+func TestAMQPConnectionReconnectRace(t *testing.T) {
+	broker := newFakeAMQPBroker(t)
+	defer broker.Close()
+
+	conf := broker.config()
+	conf.Exchanges = []Exchange{{Name: "events", Type: "topic"}}
+	conf.Queues = []Queue{{Name: "orders"}}
+	conf.Bindings = []Binding{{Exchange: "events", Queue: "orders", RoutingKeys: []string{"order.*"}}}
+	conf.Publishers = []Publisher{{Name: "orders", Exchange: "events", RoutingKey: "order.created"}}
+	conf.Subscribers = []Subscriber{{Name: "orders", Queue: "orders"}}
+
+	conn := NewAMQPConnection(conf)
+	connected := make(chan struct{}, 1)
+	conn.OnStateChange(func(state AMQPConnectionState, err error) {
+		if state == AMQPConnected {
+			select {
+			case connected <- struct{}{}:
+			default:
+			}
+		}
+	})
+
+	// the topology is declared on connection and again on each reconnection, while publishers are created
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			// the exchange is unknown till declared
+			conn.NewPublisher("orders")
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+
+	if err := conn.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-connected
+
+	for i := 0; i < 10; i++ {
+		broker.dropConnections()
+		select {
+		case <-connected:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("connection not recovered, state = %s", conn.State())
+		}
+	}
+	close(stop)
+	<-done
+}
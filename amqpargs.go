@@ -0,0 +1,199 @@
+// Copyright 2019 Luca Stasio <joshuagame@gmail.com>
+// Copyright 2019 IT Resources s.r.l.
+//
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package sgul defines common structures and functionalities for applications.
+// amqpargs.go defines the validation of AMQP queues and exchanges declaration arguments.
+package sgul
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/streadway/amqp"
+)
+
+type argKind int
+
+const (
+	stringArg argKind = iota
+	intArg
+	boolArg
+)
+
+// argSpec defines the expected type, and optionally the allowed values
+// or range, for a well-known declaration argument.
+type argSpec struct {
+	kind     argKind
+	values   []string
+	min, max int64
+}
+
+// wellKnownQueueArgs are the RabbitMQ queue arguments validated on declaration.
+var wellKnownQueueArgs = map[string]argSpec{
+	"x-message-ttl":               {kind: intArg, min: 0, max: math.MaxInt64},
+	"x-expires":                   {kind: intArg, min: 1, max: math.MaxInt64},
+	"x-max-length":                {kind: intArg, min: 0, max: math.MaxInt64},
+	"x-max-length-bytes":          {kind: intArg, min: 0, max: math.MaxInt64},
+	"x-max-priority":              {kind: intArg, min: 1, max: 255},
+	"x-delivery-limit":            {kind: intArg, min: 0, max: math.MaxInt64},
+	"x-quorum-initial-group-size": {kind: intArg, min: 1, max: math.MaxInt64},
+	"x-dead-letter-exchange":      {kind: stringArg},
+	"x-dead-letter-routing-key":   {kind: stringArg},
+	"x-overflow":                  {kind: stringArg, values: []string{"drop-head", "reject-publish", "reject-publish-dlx"}},
+	"x-queue-mode":                {kind: stringArg, values: []string{"default", "lazy"}},
+	"x-queue-type":                {kind: stringArg, values: []string{"classic", "quorum", "stream"}},
+	"x-queue-master-locator":      {kind: stringArg, values: []string{"min-masters", "client-local", "random"}},
+	"x-single-active-consumer":    {kind: boolArg},
+}
+
+// wellKnownExchangeArgs are the RabbitMQ exchange arguments validated on declaration.
+var wellKnownExchangeArgs = map[string]argSpec{
+	"alternate-exchange": {kind: stringArg},
+	"x-delayed-type":     {kind: stringArg, values: []string{"direct", "fanout", "topic", "headers"}},
+}
+
+// queueArgs returns the declaration arguments for the queue configuration:
+// the queue Args merged with the dead-lettering and TTL settings.
+func queueArgs(queue Queue) (amqp.Table, error) {
+	args, err := amqpTable(queue.Args)
+	if err != nil {
+		return nil, fmt.Errorf("queue '%s': %s", queue.Name, err)
+	}
+
+	if queue.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = queue.DeadLetterExchange
+	}
+	if queue.DeadLetterRoutingKey != "" {
+		args["x-dead-letter-routing-key"] = queue.DeadLetterRoutingKey
+	}
+	if queue.MessageTTL > 0 {
+		args["x-message-ttl"] = int64(queue.MessageTTL.Nanoseconds() / 1e6)
+	}
+
+	if err := validateArgs(args, wellKnownQueueArgs); err != nil {
+		return nil, fmt.Errorf("queue '%s': %s", queue.Name, err)
+	}
+
+	if len(args) == 0 {
+		return nil, nil
+	}
+	return args, nil
+}
+
+// exchangeArgs returns the validated declaration arguments for the exchange configuration.
+func exchangeArgs(exchange Exchange) (amqp.Table, error) {
+	args, err := amqpTable(exchange.Args)
+	if err == nil {
+		err = validateArgs(args, wellKnownExchangeArgs)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("exchange '%s': %s", exchange.Name, err)
+	}
+
+	if len(args) == 0 {
+		return nil, nil
+	}
+	return args, nil
+}
+
+// validateArgs checks the well-known arguments type and value.
+// Unknown arguments are passed through as they are.
+func validateArgs(args amqp.Table, specs map[string]argSpec) error {
+	for name, value := range args {
+		spec, ok := specs[name]
+		if !ok {
+			continue
+		}
+
+		switch spec.kind {
+		case stringArg:
+			s, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("argument %s must be a string, got %T", name, value)
+			}
+			if len(spec.values) > 0 && !ContainsString(spec.values, s) {
+				return fmt.Errorf("argument %s must be one of %v, got '%s'", name, spec.values, s)
+			}
+		case intArg:
+			n, ok := value.(int64)
+			if !ok {
+				return fmt.Errorf("argument %s must be an integer, got %T", name, value)
+			}
+			if n < spec.min || n > spec.max {
+				return fmt.Errorf("argument %s must be in [%d, %d], got %d", name, spec.min, spec.max, n)
+			}
+		case boolArg:
+			if _, ok := value.(bool); !ok {
+				return fmt.Errorf("argument %s must be a boolean, got %T", name, value)
+			}
+		}
+	}
+	return nil
+}
+
+// amqpTable converts configuration arguments into an AMQP table, normalizing numbers
+// to int64 (when integral) and nested maps to tables, so that decoded configuration
+// values are accepted by the AMQP client.
+func amqpTable(args map[string]interface{}) (amqp.Table, error) {
+	table := amqp.Table{}
+	for k, v := range args {
+		nv, err := amqpValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("argument %s: %s", k, err)
+		}
+		table[k] = nv
+	}
+	return table, nil
+}
+
+func amqpValue(v interface{}) (interface{}, error) {
+	switch value := v.(type) {
+	case int:
+		return int64(value), nil
+	case int8:
+		return int64(value), nil
+	case int16:
+		return int64(value), nil
+	case int32:
+		return int64(value), nil
+	case uint:
+		return int64(value), nil
+	case uint16:
+		return int64(value), nil
+	case uint32:
+		return int64(value), nil
+	case float32:
+		return amqpValue(float64(value))
+	case float64:
+		if value == math.Trunc(value) {
+			return int64(value), nil
+		}
+		return value, nil
+	case map[string]interface{}:
+		return amqpTable(value)
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(value))
+		for k, mv := range value {
+			m[fmt.Sprintf("%v", k)] = mv
+		}
+		return amqpTable(m)
+	case []interface{}:
+		values := make([]interface{}, len(value))
+		for i, av := range value {
+			nv, err := amqpValue(av)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = nv
+		}
+		return values, nil
+	default:
+		if err := (amqp.Table{"v": value}).Validate(); err != nil {
+			return nil, fmt.Errorf("value %T not supported", value)
+		}
+		return value, nil
+	}
+}
@@ -0,0 +1,400 @@
+// Copyright 2019 Luca Stasio <joshuagame@gmail.com>
+// Copyright 2019 IT Resources s.r.l.
+//
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package sgul defines common structures and functionalities for applications.
+// amqpbuffer.go defines the publishers local buffers, keeping events during broker outages.
+package sgul
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/streadway/amqp"
+)
+
+// Publisher buffer types.
+const (
+	PublishBufferMemory = "memory"
+	PublishBufferDisk   = "disk"
+)
+
+// DefaultPublishBufferSize is the default maximum number of buffered events.
+const DefaultPublishBufferSize = 1000
+
+// ErrPublishBufferFull is returned when an event cannot be buffered because the buffer is full.
+var ErrPublishBufferFull = errors.New("publish buffer full: event dropped")
+
+type (
+	// PublishBuffer is a bounded FIFO queue of events waiting to be published.
+	PublishBuffer interface {
+		// Push appends the event to the buffer, or returns ErrPublishBufferFull.
+		Push(event Event) error
+		// Peek returns the first event of the buffer, if any.
+		Peek() (Event, bool, error)
+		// Pop removes the first event of the buffer.
+		Pop() error
+		// Len returns the number of buffered events.
+		Len() int
+	}
+
+	// PublishBufferStats are the publisher buffer metrics.
+	PublishBufferStats struct {
+		// Depth is the number of events in the buffer.
+		Depth int
+		// Buffered is the number of events buffered since the publisher creation.
+		Buffered uint64
+		// Flushed is the number of buffered events published since the publisher creation.
+		Flushed uint64
+		// Dropped is the number of events dropped because the buffer was full.
+		Dropped uint64
+	}
+
+	// memoryPublishBuffer is an in-memory PublishBuffer. Buffered events are lost on restart.
+	memoryPublishBuffer struct {
+		mu     *sync.Mutex
+		size   int
+		events []Event
+	}
+
+	// diskPublishBuffer is a PublishBuffer keeping each event in a json file of a directory,
+	// named after its sequence number. Buffered events survive restarts.
+	// Missing event files are skipped, corrupt ones are renamed with the ".corrupt" suffix.
+	diskPublishBuffer struct {
+		mu   *sync.Mutex
+		dir  string
+		size int
+		// head is the sequence number of the first event, tail the one of the next pushed event
+		head uint64
+		tail uint64
+	}
+
+	// publisherBuffer is the publisher buffer with its metrics.
+	// mu guards flushing and is never held while publishing.
+	publisherBuffer struct {
+		// 64-bit aligned counters first
+		buffered uint64
+		flushed  uint64
+		dropped  uint64
+		PublishBuffer
+		mu       *sync.Mutex
+		flushing bool
+	}
+)
+
+// NewMemoryPublishBuffer returns a new in-memory PublishBuffer keeping at most size events.
+func NewMemoryPublishBuffer(size int) PublishBuffer {
+	if size <= 0 {
+		size = DefaultPublishBufferSize
+	}
+	return &memoryPublishBuffer{mu: &sync.Mutex{}, size: size}
+}
+
+// Push appends the event to the buffer.
+func (b *memoryPublishBuffer) Push(event Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.events) >= b.size {
+		return ErrPublishBufferFull
+	}
+	b.events = append(b.events, event)
+	return nil
+}
+
+// Peek returns the first event of the buffer.
+func (b *memoryPublishBuffer) Peek() (Event, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.events) == 0 {
+		return Event{}, false, nil
+	}
+	return b.events[0], true, nil
+}
+
+// Pop removes the first event of the buffer.
+func (b *memoryPublishBuffer) Pop() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.events) > 0 {
+		b.events = b.events[1:]
+	}
+	return nil
+}
+
+// Len returns the number of buffered events.
+func (b *memoryPublishBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.events)
+}
+
+// NewDiskPublishBuffer returns a new disk-backed PublishBuffer keeping at most size
+// events into the dir directory. Events buffered by a previous run are kept.
+func NewDiskPublishBuffer(dir string, size int) (PublishBuffer, error) {
+	if size <= 0 {
+		size = DefaultPublishBufferSize
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	seqs := []uint64{}
+	for _, f := range files {
+		if seq, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), ".json"), 10, 64); err == nil && strings.HasSuffix(f.Name(), ".json") {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	b := &diskPublishBuffer{mu: &sync.Mutex{}, dir: dir, size: size}
+	if len(seqs) > 0 {
+		b.head = seqs[0]
+		b.tail = seqs[len(seqs)-1] + 1
+	}
+	return b, nil
+}
+
+func (b *diskPublishBuffer) path(seq uint64) string {
+	return filepath.Join(b.dir, fmt.Sprintf("%020d.json", seq))
+}
+
+// Push writes the event to the buffer directory.
+func (b *diskPublishBuffer) Push(event Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if int(b.tail-b.head) >= b.size {
+		return ErrPublishBufferFull
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	// write and rename, so that a crash never leaves a partial event
+	tmp := b.path(b.tail) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, b.path(b.tail)); err != nil {
+		return err
+	}
+	b.tail++
+	return nil
+}
+
+// Peek reads the first event of the buffer, skipping missing and corrupt event files.
+func (b *diskPublishBuffer) Peek() (Event, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ; b.head != b.tail; b.head++ {
+		path := b.path(b.head)
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			log.Printf("publisher: skipping missing buffered event %s", path)
+			continue
+		}
+		if err != nil {
+			return Event{}, false, err
+		}
+
+		var event Event
+		if err := json.Unmarshal(data, &event); err != nil {
+			log.Printf("publisher: quarantining corrupt buffered event %s: %s", path, err)
+			if err := os.Rename(path, path+".corrupt"); err != nil {
+				return Event{}, false, err
+			}
+			continue
+		}
+		return event, true, nil
+	}
+	return Event{}, false, nil
+}
+
+// Pop removes the first event file of the buffer.
+func (b *diskPublishBuffer) Pop() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.head == b.tail {
+		return nil
+	}
+	if err := os.Remove(b.path(b.head)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	b.head++
+	return nil
+}
+
+// Len returns the number of buffered events.
+func (b *diskPublishBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int(b.tail - b.head)
+}
+
+// newPublishBuffer returns the buffer for the publisher configuration, or nil if not configured.
+func newPublishBuffer(p Publisher) (PublishBuffer, error) {
+	var buffer PublishBuffer
+	switch strings.ToLower(p.Buffer.Type) {
+	case "":
+		return nil, nil
+	case PublishBufferMemory:
+		buffer = NewMemoryPublishBuffer(p.Buffer.Size)
+	case PublishBufferDisk:
+		if p.Buffer.Dir == "" {
+			return nil, fmt.Errorf("publisher '%s': missing disk buffer directory", p.Name)
+		}
+		var err error
+		if buffer, err = NewDiskPublishBuffer(filepath.Join(p.Buffer.Dir, p.Name), p.Buffer.Size); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("publisher '%s': unknown buffer type '%s'", p.Name, p.Buffer.Type)
+	}
+
+	return buffer, nil
+}
+
+// SetBuffer sets the publisher buffer, keeping events during broker outages:
+// they are published, in order, as soon as the connection is recovered.
+func (pub *AMQPPublisher) SetBuffer(buffer PublishBuffer) {
+	pub.buffer = &publisherBuffer{PublishBuffer: buffer, mu: &sync.Mutex{}}
+	pub.Connection.OnStateChange(func(state AMQPConnectionState, err error) {
+		if state == AMQPConnected {
+			go pub.flush()
+		}
+	})
+}
+
+// BufferStats returns the publisher buffer metrics.
+func (pub *AMQPPublisher) BufferStats() PublishBufferStats {
+	if pub.buffer == nil {
+		return PublishBufferStats{}
+	}
+	return PublishBufferStats{
+		Depth:    pub.buffer.Len(),
+		Buffered: atomic.LoadUint64(&pub.buffer.buffered),
+		Flushed:  atomic.LoadUint64(&pub.buffer.flushed),
+		Dropped:  atomic.LoadUint64(&pub.buffer.dropped),
+	}
+}
+
+// publishBuffered publishes the event, or buffers it if the broker is unreachable or
+// if older events are still buffered (to keep the publishing order).
+func (pub *AMQPPublisher) publishBuffered(event Event) error {
+	if event.ID == "" {
+		// the event is published with the same ID when flushed
+		event.ID = newUUID()
+	}
+
+	pub.buffer.mu.Lock()
+	if pub.buffer.Len() > 0 || pub.Connection.State() != AMQPConnected {
+		pub.buffer.mu.Unlock()
+		return pub.bufferEvent(event)
+	}
+	pub.buffer.mu.Unlock()
+
+	err := pub.send(event)
+	if err != nil && pub.isOutage(err) {
+		return pub.bufferEvent(event)
+	}
+	return err
+}
+
+// bufferEvent pushes the event into the buffer, starting a flush if the connection is up.
+func (pub *AMQPPublisher) bufferEvent(event Event) error {
+	if err := pub.buffer.Push(event); err != nil {
+		if err == ErrPublishBufferFull {
+			atomic.AddUint64(&pub.buffer.dropped, 1)
+		}
+		return err
+	}
+	atomic.AddUint64(&pub.buffer.buffered, 1)
+
+	if pub.Connection.State() == AMQPConnected {
+		go pub.flush()
+	}
+	return nil
+}
+
+// isOutage checks if the publishing error is due to a broker outage,
+// including a lost channel or a confirmation not received in time.
+func (pub *AMQPPublisher) isOutage(err error) bool {
+	switch {
+	case err == amqp.ErrClosed, err == ErrAMQPConnectionClosed, err == context.DeadlineExceeded:
+		return true
+	case pub.Connection.State() != AMQPConnected:
+		return true
+	}
+	_, ok := err.(*amqp.Error)
+	return ok
+}
+
+// flush publishes the buffered events in order, till the buffer is empty or publishing fails.
+// Only one flush at a time runs for a publisher: events buffered meanwhile are published by it.
+func (pub *AMQPPublisher) flush() {
+	pub.buffer.mu.Lock()
+	if pub.buffer.flushing {
+		pub.buffer.mu.Unlock()
+		return
+	}
+	pub.buffer.flushing = true
+	pub.buffer.mu.Unlock()
+
+	stop := func() {
+		pub.buffer.mu.Lock()
+		pub.buffer.flushing = false
+		pub.buffer.mu.Unlock()
+	}
+
+	for {
+		// the buffer is found empty and the flush stops at once,
+		// so that events buffered right after start a new flush
+		pub.buffer.mu.Lock()
+		event, ok, err := pub.buffer.Peek()
+		if err != nil || !ok {
+			pub.buffer.flushing = false
+			pub.buffer.mu.Unlock()
+			if err != nil {
+				log.Printf("publisher: unable to read buffered event: %s", err)
+			}
+			return
+		}
+		pub.buffer.mu.Unlock()
+
+		counter := &pub.buffer.flushed
+		if err := pub.send(event); err != nil {
+			if pub.isOutage(err) {
+				stop()
+				log.Printf("publisher: unable to flush buffered event %s: %s", event.ID, err)
+				return
+			}
+			// the event will never be published (a.e. nacked or unroutable)
+			log.Printf("publisher: dropping buffered event %s: %s", event.ID, err)
+			counter = &pub.buffer.dropped
+		}
+
+		if err := pub.buffer.Pop(); err != nil {
+			stop()
+			log.Printf("publisher: unable to remove buffered event %s: %s", event.ID, err)
+			return
+		}
+		atomic.AddUint64(counter, 1)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2019 Luca Stasio <joshuagame@gmail.com>
+// Copyright 2019 IT Resources s.r.l.
+//
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package sgul
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDiskPublishBufferUnreadableHead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sgul-buffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	buffer, err := NewDiskPublishBuffer(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := []Event{NewEvent("A", "test", nil), NewEvent("B", "test", nil), NewEvent("C", "test", nil)}
+	for _, event := range events {
+		if err := buffer.Push(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the first event file is corrupt, the second one is missing
+	disk := buffer.(*diskPublishBuffer)
+	if err := ioutil.WriteFile(disk.path(0), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(disk.path(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	event, ok, err := buffer.Peek()
+	if err != nil || !ok {
+		t.Fatalf("Peek() = %v, %v, want the third event", ok, err)
+	}
+	if event.ID != events[2].ID {
+		t.Errorf("Peek() event ID = %s, want %s", event.ID, events[2].ID)
+	}
+	if n := buffer.Len(); n != 1 {
+		t.Errorf("Len() = %d, want 1", n)
+	}
+	if _, err := os.Stat(disk.path(0) + ".corrupt"); err != nil {
+		t.Errorf("corrupt event not quarantined: %s", err)
+	}
+
+	// quarantined events are not reloaded
+	if err := buffer.Pop(); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := NewDiskPublishBuffer(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := reloaded.Peek(); ok || err != nil {
+		t.Errorf("reloaded Peek() = %v, %v, want an empty buffer", ok, err)
+	}
+}
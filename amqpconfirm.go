@@ -0,0 +1,165 @@
+// Copyright 2019 Luca Stasio <joshuagame@gmail.com>
+// Copyright 2019 IT Resources s.r.l.
+//
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package sgul defines common structures and functionalities for applications.
+// amqpconfirm.go defines the AMQP channel in confirm mode shared by concurrent publishings.
+package sgul
+
+import (
+	"context"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+type (
+	// amqpConfirmChannel is an AMQP channel in confirm mode shared by concurrent publishings.
+	// Each message is tracked by its delivery tag and the broker confirmations are dispatched
+	// to the waiting publishings, so that many confirmations can be in flight at once.
+	amqpConfirmChannel struct {
+		conn    *AMQPConnection
+		mu      *sync.Mutex
+		channel *amqp.Channel
+		// last delivery tag assigned on the channel
+		tag     uint64
+		pending map[uint64]*pendingConfirm
+	}
+
+	// pendingConfirm is a published message waiting for the broker confirmation.
+	pendingConfirm struct {
+		messageID string
+		returned  bool
+		done      chan error
+	}
+)
+
+// newAMQPConfirmChannel returns a new confirm channel on the AMQP connection.
+// The channel is opened on first publish (and again after a connection loss).
+func newAMQPConfirmChannel(conn *AMQPConnection) *amqpConfirmChannel {
+	return &amqpConfirmChannel{
+		conn:    conn,
+		mu:      &sync.Mutex{},
+		pending: make(map[uint64]*pendingConfirm),
+	}
+}
+
+// publish publishes a message and blocks until the broker acks or nacks it, or the context is done.
+// Unroutable messages published with the mandatory flag are returned by the broker:
+// in this case ErrAMQPUnroutable is returned.
+func (c *amqpConfirmChannel) publish(ctx context.Context, exchange string, key string, mandatory bool, immediate bool, msg amqp.Publishing) error {
+	c.mu.Lock()
+	if err := c.open(); err != nil {
+		c.mu.Unlock()
+		return err
+	}
+
+	// delivery tags are assigned in publishing order: publish holding the lock
+	tag := c.tag + 1
+	p := &pendingConfirm{messageID: msg.MessageId, done: make(chan error, 1)}
+	if err := c.channel.Publish(exchange, key, mandatory, immediate, msg); err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	c.tag = tag
+	c.pending[tag] = p
+	c.mu.Unlock()
+
+	select {
+	case err := <-p.done:
+		return err
+	case <-ctx.Done():
+		// a late confirmation is simply discarded
+		c.mu.Lock()
+		delete(c.pending, tag)
+		c.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// open opens the channel in confirm mode, if not already open. Must be called holding mu.
+func (c *amqpConfirmChannel) open() error {
+	if c.channel != nil {
+		return nil
+	}
+
+	c.conn.mu.RLock()
+	connection := c.conn.Connection
+	c.conn.mu.RUnlock()
+	if connection == nil {
+		return amqp.ErrClosed
+	}
+
+	channel, err := connection.Channel()
+	if err != nil {
+		return err
+	}
+	if err := channel.Confirm(false); err != nil {
+		channel.Close()
+		return err
+	}
+
+	// the broker sends the return before the ack of an unroutable message: returns
+	// are not buffered so that they are dispatched before the relative confirmation.
+	confirms := channel.NotifyPublish(make(chan amqp.Confirmation))
+	returns := channel.NotifyReturn(make(chan amqp.Return))
+
+	c.channel = channel
+	c.tag = 0
+	go c.dispatch(channel, confirms, returns)
+	return nil
+}
+
+// dispatch dispatches the broker confirmations and returns to the pending publishings
+// till the channel is closed: then the pending publishings fail with ErrAMQPConnectionClosed.
+func (c *amqpConfirmChannel) dispatch(channel *amqp.Channel, confirms chan amqp.Confirmation, returns chan amqp.Return) {
+	for {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			c.mu.Lock()
+			for _, p := range c.pending {
+				if p.messageID == r.MessageId {
+					p.returned = true
+				}
+			}
+			c.mu.Unlock()
+
+		case confirm, ok := <-confirms:
+			if !ok {
+				c.mu.Lock()
+				if c.channel == channel {
+					c.channel = nil
+					for tag, p := range c.pending {
+						p.done <- ErrAMQPConnectionClosed
+						delete(c.pending, tag)
+					}
+				}
+				c.mu.Unlock()
+				return
+			}
+
+			c.mu.Lock()
+			p, found := c.pending[confirm.DeliveryTag]
+			delete(c.pending, confirm.DeliveryTag)
+			c.mu.Unlock()
+			if !found {
+				continue
+			}
+
+			switch {
+			case !confirm.Ack:
+				p.done <- ErrAMQPNack
+			case p.returned:
+				p.done <- ErrAMQPUnroutable
+			default:
+				p.done <- nil
+			}
+		}
+	}
+}
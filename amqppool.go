@@ -0,0 +1,121 @@
+// Copyright 2019 Luca Stasio <joshuagame@gmail.com>
+// Copyright 2019 IT Resources s.r.l.
+//
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package sgul defines common structures and functionalities for applications.
+// amqppool.go defines the AMQP channels pool used for concurrent publishing.
+package sgul
+
+import (
+	"github.com/streadway/amqp"
+)
+
+// DefaultAMQPChannelPoolSize is the default maximum number of publishing channels
+// opened on an AMQP connection.
+const DefaultAMQPChannelPoolSize = 10
+
+type (
+	// pooledChannel is an AMQP channel kept in the pool.
+	pooledChannel struct {
+		*amqp.Channel
+		closed chan *amqp.Error
+	}
+
+	// amqpChannelPool keeps a bounded set of AMQP channels so that each channel
+	// is used by a single goroutine at a time: AMQP channels are not safe for
+	// concurrent publishing.
+	amqpChannelPool struct {
+		conn   *AMQPConnection
+		idle   chan *pooledChannel
+		tokens chan struct{}
+	}
+)
+
+// newAMQPChannelPool returns a new channels pool on the AMQP connection.
+func newAMQPChannelPool(conn *AMQPConnection, size int) *amqpChannelPool {
+	if size <= 0 {
+		size = DefaultAMQPChannelPoolSize
+	}
+	return &amqpChannelPool{
+		conn:   conn,
+		idle:   make(chan *pooledChannel, size),
+		tokens: make(chan struct{}, size),
+	}
+}
+
+// get returns an open channel for exclusive use, opening a new one if there
+// is no idle channel. It blocks while all the pool channels are in use.
+func (p *amqpChannelPool) get() (*pooledChannel, error) {
+	p.tokens <- struct{}{}
+
+	for {
+		select {
+		case ch := <-p.idle:
+			if ch.isClosed() {
+				continue
+			}
+			return ch, nil
+		default:
+			ch, err := p.open()
+			if err != nil {
+				<-p.tokens
+				return nil, err
+			}
+			return ch, nil
+		}
+	}
+}
+
+// put gives a channel back to the pool. Closed channels are discarded.
+func (p *amqpChannelPool) put(ch *pooledChannel) {
+	if !ch.isClosed() {
+		p.idle <- ch
+	}
+	<-p.tokens
+}
+
+// open opens a new channel on the current connection.
+func (p *amqpChannelPool) open() (*pooledChannel, error) {
+	p.conn.mu.RLock()
+	connection := p.conn.Connection
+	p.conn.mu.RUnlock()
+
+	if connection == nil {
+		return nil, amqp.ErrClosed
+	}
+
+	ch, err := connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	go p.conn.handleReturns(ch.NotifyReturn(make(chan amqp.Return, 1)))
+
+	return &pooledChannel{
+		Channel: ch,
+		closed:  ch.NotifyClose(make(chan *amqp.Error, 1)),
+	}, nil
+}
+
+// publish publishes a message on a channel taken from the connection pool.
+func (conn *AMQPConnection) publish(exchange string, key string, mandatory bool, immediate bool, msg amqp.Publishing) error {
+	ch, err := conn.pool.get()
+	if err != nil {
+		return err
+	}
+	defer conn.pool.put(ch)
+
+	return ch.Publish(exchange, key, mandatory, immediate, msg)
+}
+
+// isClosed checks if the channel has been closed (a.e. on connection loss).
+func (ch *pooledChannel) isClosed() bool {
+	select {
+	case <-ch.closed:
+		return true
+	default:
+		return false
+	}
+}
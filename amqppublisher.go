@@ -0,0 +1,239 @@
+// Copyright 2019 Luca Stasio <joshuagame@gmail.com>
+// Copyright 2019 IT Resources s.r.l.
+//
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package sgul defines common structures and functionalities for applications.
+// amqppublisher.go defines the AMQP Publisher.
+package sgul
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// ErrAMQPNack is returned if the broker nacks a published message.
+var ErrAMQPNack = errors.New("amqp message nacked by the broker")
+
+// ErrAMQPUnroutable is returned if the broker returns a mandatory message
+// that cannot be routed to any queue.
+var ErrAMQPUnroutable = errors.New("amqp message unroutable")
+
+// AMQPPublisher define the AMQP Publisher structure.
+// Normally can be used as a sort of repository by a business service.
+type AMQPPublisher struct {
+	Connection   *AMQPConnection
+	Exchange     string
+	ExchangeType string
+	RoutingKey   string
+	ContentType  string
+	// ContentEncoding is the message body compression (a.e. "gzip").
+	ContentEncoding string
+	DeliveryMode    uint8
+	// Mandatory makes the broker return unroutable messages.
+	Mandatory bool
+	// Immediate makes the broker return messages not immediately consumable
+	// (not supported by RabbitMQ).
+	Immediate bool
+	// Confirm makes Publish wait for the broker confirmation.
+	Confirm bool
+	// ConfirmTimeout is the maximum wait time for the broker confirmation on Publish.
+	ConfirmTimeout time.Duration
+	// Format is the events wire format (EventFormatSgul, EventFormatStructured or EventFormatBinary).
+	Format string
+
+	// buffer keeps events during broker outages (nil if not buffered)
+	buffer *publisherBuffer
+
+	// channel in confirm mode shared by the publisher confirmed publishings
+	confirm *amqpConfirmChannel
+}
+
+func (conn *AMQPConnection) initPublishers() error {
+	for _, p := range conn.conf.Publishers {
+		if conn.publisher(p.Name) == nil {
+			publisher, err := conn.NewPublisher(p.Name)
+			if err != nil {
+				return err
+			}
+			conn.mu.Lock()
+			if conn.Publishers[p.Name] == nil {
+				conn.Publishers[p.Name] = publisher
+			}
+			conn.mu.Unlock()
+		}
+	}
+	return nil
+}
+
+// // Publisher returns a new AMQP Publisher on this connection.
+// func (conn *AMQPConnection) Publisher(exchange string, exchangeType string, routingKey string) (*AMQPPublisher, error) {
+// 	return NewAMQPPublisher(conn, exchange, exchangeType, routingKey)
+// }
+
+// NewAMQPPublisher return a new AMQP Publisher object.
+func NewAMQPPublisher(connection *AMQPConnection, exchange string, exchangeType string, routingKey string) (*AMQPPublisher, error) {
+	if err := connection.channel().ExchangeDeclare(
+		exchange, exchangeType,
+		true, false, false, false, nil); err != nil {
+		return nil, err
+	}
+
+	return &AMQPPublisher{
+		Connection:   connection,
+		Exchange:     exchange,
+		ExchangeType: exchangeType,
+		RoutingKey:   routingKey,
+		confirm:      newAMQPConfirmChannel(connection),
+	}, nil
+}
+
+// NewPublisher return a new AMQP Publisher object initialized with "name"-publisher configuration.
+func (conn *AMQPConnection) NewPublisher(name string) (*AMQPPublisher, error) {
+	if pub := conn.publisher(name); pub != nil {
+		return pub, nil
+	}
+
+	// get publisher configuration
+	p, ok := publisherFor(conn.conf, name)
+
+	if !ok {
+		return nil, fmt.Errorf("no configuration fond for publisher '%s'", name)
+	}
+
+	// initialize and register the AMQP Publisher struct
+	ei, ok := conn.exchange(p.Exchange)
+	if !ok {
+		if p.Exchange != "" && !strings.HasPrefix(p.Exchange, "amq.") {
+			return nil, fmt.Errorf("publisher '%s': undeclared exchange '%s'", name, p.Exchange)
+		}
+		ei = exchangeInfo{exname: p.Exchange}
+	}
+	publisher := &AMQPPublisher{
+		Connection:      conn,
+		Exchange:        ei.exname,
+		ExchangeType:    ei.extype,
+		RoutingKey:      p.RoutingKey,
+		ContentType:     p.ContentType,
+		ContentEncoding: p.ContentEncoding,
+		DeliveryMode:    p.DeliveryMode,
+		Mandatory:       p.Mandatory,
+		Immediate:       p.Immediate,
+		Confirm:         p.Confirm,
+		ConfirmTimeout:  p.ConfirmTimeout,
+		Format:          p.Format,
+		confirm:         newAMQPConfirmChannel(conn),
+	}
+
+	buffer, err := newPublishBuffer(p)
+	if err != nil {
+		return nil, err
+	}
+	if buffer != nil {
+		publisher.SetBuffer(buffer)
+	}
+
+	return publisher, nil
+}
+
+func publisherFor(conf AMQP, name string) (Publisher, bool) {
+	for _, publisher := range conf.Publishers {
+		if strings.ToLower(publisher.Name) == strings.ToLower(name) {
+			return publisher, true
+		}
+	}
+
+	// no publisher configuration found for "name"
+	return Publisher{}, false
+}
+
+func exchangeFor(conf AMQP, name string) (Exchange, bool) {
+	for _, exchange := range conf.Exchanges {
+		if exchange.Name == name {
+			return exchange, true
+		}
+	}
+
+	// no exchange configuration found for "name"
+	return Exchange{}, false
+}
+
+// Publish send a message to the AMQP Exchange.
+// If the publisher is configured in confirm mode, it waits for the broker
+// confirmation up to the publisher ConfirmTimeout (if any).
+// If the publisher has a buffer, events are buffered while the broker is unreachable:
+// in this case nil is returned, or ErrPublishBufferFull if the buffer is full.
+func (pub *AMQPPublisher) Publish(event Event) error {
+	if pub.buffer != nil {
+		return pub.publishBuffered(event)
+	}
+	return pub.send(event)
+}
+
+// send publishes the event, waiting for the broker confirmation in confirm mode.
+func (pub *AMQPPublisher) send(event Event) error {
+	if pub.Confirm {
+		ctx := context.Background()
+		if pub.ConfirmTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, pub.ConfirmTimeout)
+			defer cancel()
+		}
+		return pub.PublishWithConfirm(ctx, event)
+	}
+
+	msg, err := pub.publishing(event)
+	if err != nil {
+		return err
+	}
+
+	// AMQP channels are not safe for concurrent publishing:
+	// publish on an exclusive one from the connection pool.
+	return pub.Connection.publish(
+		pub.Exchange,
+		pub.RoutingKey,
+		pub.Mandatory,
+		pub.Immediate,
+		msg)
+}
+
+// PublishWithConfirm send a message to the AMQP Exchange and blocks until the broker
+// acks or nacks it, or the context is done.
+// Confirmations are tracked by delivery tag, so concurrent publishings wait for
+// their confirmations at the same time.
+// Unroutable messages published with the mandatory flag are returned by the broker:
+// in this case ErrAMQPUnroutable is returned.
+func (pub *AMQPPublisher) PublishWithConfirm(ctx context.Context, event Event) error {
+	msg, err := pub.publishing(event)
+	if err != nil {
+		return err
+	}
+
+	return pub.confirm.publish(ctx, pub.Exchange, pub.RoutingKey, pub.Mandatory, pub.Immediate, msg)
+}
+
+// publishing returns the AMQP message for the event.
+func (pub *AMQPPublisher) publishing(event Event) (amqp.Publishing, error) {
+	if event.ID == "" {
+		event.ID = newUUID()
+	}
+	msg := amqp.Publishing{
+		MessageId:       event.ID,
+		DeliveryMode:    pub.DeliveryMode,
+		ContentType:     pub.ContentType,
+		ContentEncoding: pub.ContentEncoding,
+		CorrelationId:   event.CorrelationID,
+		Timestamp:       time.Now(),
+	}
+	if err := encodeEvent(pub.Format, event, &msg); err != nil {
+		return amqp.Publishing{}, err
+	}
+
+	return msg, nil
+}
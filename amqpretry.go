@@ -0,0 +1,165 @@
+// Copyright 2019 Luca Stasio <joshuagame@gmail.com>
+// Copyright 2019 IT Resources s.r.l.
+//
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package sgul defines common structures and functionalities for applications.
+// amqpretry.go defines delayed retries and dead-lettering for AMQP subscribers.
+package sgul
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// DefaultRetryDelay is the retry delay used if a subscriber has retries but no delays configured.
+const DefaultRetryDelay = 5 * time.Second
+
+// Headers set on retried and dead-lettered messages.
+const (
+	HeaderRetryCount    = "x-sgul-retry-count"
+	HeaderFailureReason = "x-sgul-failure-reason"
+	HeaderFailedQueue   = "x-sgul-failed-queue"
+)
+
+// retryQueueName returns the name of the retry queue for a queue and a delay (a.e. "users.retry.5s").
+func retryQueueName(queue string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%s", queue, delay)
+}
+
+// retryDelays returns the subscriber retry delays.
+func (sub *AMQPSubscriber) retryDelays() []time.Duration {
+	if len(sub.RetryDelays) == 0 {
+		return []time.Duration{DefaultRetryDelay}
+	}
+	return sub.RetryDelays
+}
+
+// declareRetryQueues declares the TTL retry queues for each configured subscriber with retries.
+// Subscribers not in configuration must have their retry queues declared elsewhere:
+// retries to a missing queue are unroutable and the messages are requeued.
+// Messages expired in a retry queue are dead-lettered, through the default exchange,
+// back to the subscriber queue.
+func (conn *AMQPConnection) declareRetryQueues() error {
+	for _, sub := range conn.subscribers() {
+		if sub.MaxAttempts <= 0 {
+			continue
+		}
+
+		for _, delay := range sub.retryDelays() {
+			_, err := conn.channel().QueueDeclare(
+				retryQueueName(sub.Queue, delay),
+				true,
+				false,
+				false,
+				false,
+				retryQueueArgs(sub.Queue, delay),
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// retryQueueArgs returns the declaration arguments of the queue retrying messages of queue after delay.
+func retryQueueArgs(queue string, delay time.Duration) amqp.Table {
+	return amqp.Table{
+		"x-message-ttl":             int64(delay / time.Millisecond),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": queue,
+	}
+}
+
+// retry sends a failed message to the retry queue for its attempt, or dead-letters it
+// if it has been retried MaxAttempts times already. The message is published as mandatory
+// and the original delivery is acked only once the broker confirmed and routed it:
+// on failure (a.e. a retry queue not declared) the original delivery is nacked and requeued.
+func (sub *AMQPSubscriber) retry(d amqp.Delivery, cause error) error {
+	count := retryCount(d)
+	if count >= sub.MaxAttempts {
+		return sub.deadLetter(d, cause)
+	}
+
+	delays := sub.retryDelays()
+	delay := delays[len(delays)-1]
+	if count < len(delays) {
+		delay = delays[count]
+	}
+
+	msg := republishing(d)
+	msg.Headers[HeaderRetryCount] = int32(count + 1)
+	msg.Headers[HeaderFailureReason] = cause.Error()
+	if err := sub.Connection.confirm.publish(context.Background(), "", retryQueueName(sub.Queue, delay), true, false, msg); err != nil {
+		d.Nack(false, true)
+		return err
+	}
+	return d.Ack(false)
+}
+
+// deadLetter sends a failed message to the subscriber dead letter exchange with the failure
+// reason in headers. The message is published as mandatory and the original delivery is acked
+// only once the broker confirmed and routed it, otherwise it is nacked and requeued.
+// If the subscriber has no dead letter exchange, the message is rejected
+// (and dead-lettered by the broker if the queue has one).
+func (sub *AMQPSubscriber) deadLetter(d amqp.Delivery, cause error) error {
+	if sub.DeadLetterExchange == "" {
+		return d.Nack(false, false)
+	}
+
+	routingKey := sub.DeadLetterRoutingKey
+	if routingKey == "" {
+		routingKey = d.RoutingKey
+	}
+
+	msg := republishing(d)
+	msg.Headers[HeaderFailureReason] = cause.Error()
+	msg.Headers[HeaderFailedQueue] = sub.Queue
+	if err := sub.Connection.confirm.publish(context.Background(), sub.DeadLetterExchange, routingKey, true, false, msg); err != nil {
+		d.Nack(false, true)
+		return err
+	}
+	return d.Ack(false)
+}
+
+// retryCount returns the number of retries already done for a delivery.
+func retryCount(d amqp.Delivery) int {
+	switch count := d.Headers[HeaderRetryCount].(type) {
+	case int32:
+		return int(count)
+	case int64:
+		return int(count)
+	case int:
+		return count
+	default:
+		return 0
+	}
+}
+
+// republishing returns a copy of the delivered message to be published again.
+func republishing(d amqp.Delivery) amqp.Publishing {
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}
+}
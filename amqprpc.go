@@ -0,0 +1,237 @@
+// Copyright 2019 Luca Stasio <joshuagame@gmail.com>
+// Copyright 2019 IT Resources s.r.l.
+//
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package sgul defines common structures and functionalities for applications.
+// amqprpc.go defines the request/reply RPC pattern over AMQP.
+package sgul
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// directReplyTo is the RabbitMQ direct reply-to pseudo queue.
+const directReplyTo = "amq.rabbitmq.reply-to"
+
+// HeaderRPCError is the reply header carrying the RPC server handler error.
+const HeaderRPCError = "x-sgul-rpc-error"
+
+type ctxDKey int
+
+const ctxDeliveryKey ctxDKey = iota
+
+// ErrDeliveryNotInContext is returned if there is no AMQP Delivery in the handler context.
+var ErrDeliveryNotInContext = errors.New("No AMQP Delivery in context")
+
+// ErrNoReplyTo is returned by an RPC handler receiving a message with no ReplyTo.
+var ErrNoReplyTo = errors.New("no reply-to in rpc request")
+
+type (
+	// RPCHandler is the func type to handle RPC requests: the returned event is
+	// sent back to the caller.
+	RPCHandler func(ctx context.Context, request Event) (Event, error)
+
+	// RPCError is returned by Call if the RPC server handler fails.
+	RPCError struct {
+		Message string
+	}
+
+	// amqpRPCClient publishes requests and receives replies on a dedicated channel
+	// using the RabbitMQ direct reply-to.
+	amqpRPCClient struct {
+		conn    *AMQPConnection
+		mu      *sync.Mutex
+		channel *amqp.Channel
+		closed  chan *amqp.Error
+		pending map[string]pendingCall
+	}
+
+	// pendingCall is a call waiting for its reply on a channel.
+	pendingCall struct {
+		reply   chan amqp.Delivery
+		channel *amqp.Channel
+	}
+)
+
+// Error returns the RPC server handler error message.
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("rpc server error: %s", e.Message)
+}
+
+func newAMQPRPCClient(conn *AMQPConnection) *amqpRPCClient {
+	return &amqpRPCClient{
+		conn:    conn,
+		mu:      &sync.Mutex{},
+		pending: make(map[string]pendingCall),
+	}
+}
+
+// GetDelivery returns the AMQP Delivery of the event being handled from the handler context.
+func GetDelivery(ctx context.Context) (amqp.Delivery, error) {
+	if d, ok := ctx.Value(ctxDeliveryKey).(amqp.Delivery); ok {
+		return d, nil
+	}
+	return amqp.Delivery{}, ErrDeliveryNotInContext
+}
+
+// Call publishes the request event with the "publisherName"-publisher and waits for
+// the correlated reply. The call timeout is the context deadline.
+func (conn *AMQPConnection) Call(ctx context.Context, publisherName string, event Event) (Event, error) {
+	pub := conn.publisher(publisherName)
+	if pub == nil {
+		return Event{}, fmt.Errorf("no publisher found with name '%s'", publisherName)
+	}
+
+	msg, err := pub.publishing(event)
+	if err != nil {
+		return Event{}, err
+	}
+	msg.CorrelationId = newUUID()
+	msg.ReplyTo = directReplyTo
+
+	reply, err := conn.rpc.send(pub, msg)
+	if err != nil {
+		return Event{}, err
+	}
+	defer conn.rpc.forget(msg.CorrelationId)
+
+	select {
+	case d, ok := <-reply:
+		if !ok {
+			return Event{}, ErrAMQPConnectionClosed
+		}
+		if rpcErr, ok := d.Headers[HeaderRPCError].(string); ok {
+			return Event{}, &RPCError{Message: rpcErr}
+		}
+
+		return decodeEvent(d)
+	case <-ctx.Done():
+		return Event{}, ctx.Err()
+	}
+}
+
+// HandleRPC registers an RPC handler for the "name"-subscriber: each request is passed
+// to the handler and its result (or error) is published to the request ReplyTo queue
+// with the request CorrelationId, waiting for the broker confirmation.
+func (conn *AMQPConnection) HandleRPC(name string, handler RPCHandler) {
+	conn.Handle(name, func(ctx context.Context, request Event) error {
+		d, err := GetDelivery(ctx)
+		if err != nil {
+			return err
+		}
+		if d.ReplyTo == "" {
+			return ErrNoReplyTo
+		}
+
+		msg := amqp.Publishing{
+			Headers:         amqp.Table{},
+			ContentType:     d.ContentType,
+			ContentEncoding: d.ContentEncoding,
+			CorrelationId:   d.CorrelationId,
+		}
+
+		response, herr := handler(ctx, request)
+		if herr != nil {
+			msg.Headers[HeaderRPCError] = herr.Error()
+		} else if err := encodeEvent(deliveryFormat(d), response, &msg); err != nil {
+			return err
+		}
+
+		// the reply is confirmed before the request delivery is acked
+		return conn.confirm.publish(ctx, "", d.ReplyTo, false, false, msg)
+	})
+}
+
+// send registers the pending call and publishes the request on the rpc channel.
+func (rpc *amqpRPCClient) send(pub *AMQPPublisher, msg amqp.Publishing) (chan amqp.Delivery, error) {
+	rpc.mu.Lock()
+	defer rpc.mu.Unlock()
+
+	if err := rpc.open(); err != nil {
+		return nil, err
+	}
+
+	reply := make(chan amqp.Delivery, 1)
+	rpc.pending[msg.CorrelationId] = pendingCall{reply: reply, channel: rpc.channel}
+
+	if err := rpc.channel.Publish(pub.Exchange, pub.RoutingKey, pub.Mandatory, pub.Immediate, msg); err != nil {
+		delete(rpc.pending, msg.CorrelationId)
+		return nil, err
+	}
+	return reply, nil
+}
+
+// forget removes a pending call.
+func (rpc *amqpRPCClient) forget(correlationID string) {
+	rpc.mu.Lock()
+	delete(rpc.pending, correlationID)
+	rpc.mu.Unlock()
+}
+
+// open opens the rpc channel and starts consuming replies, if not already
+// open (or if closed by a connection loss). Must be called holding mu.
+func (rpc *amqpRPCClient) open() error {
+	if rpc.channel != nil {
+		select {
+		case <-rpc.closed:
+		default:
+			return nil
+		}
+	}
+
+	rpc.conn.mu.RLock()
+	connection := rpc.conn.Connection
+	rpc.conn.mu.RUnlock()
+	if connection == nil {
+		return amqp.ErrClosed
+	}
+
+	channel, err := connection.Channel()
+	if err != nil {
+		return err
+	}
+
+	// direct reply-to consumers must be in no-ack mode
+	replies, err := channel.Consume(directReplyTo, "", true, false, false, false, nil)
+	if err != nil {
+		channel.Close()
+		return err
+	}
+
+	rpc.channel = channel
+	rpc.closed = channel.NotifyClose(make(chan *amqp.Error, 1))
+	go rpc.dispatch(channel, replies)
+
+	return nil
+}
+
+// dispatch passes each reply to its pending call. When the channel is closed,
+// the calls pending on it are failed.
+func (rpc *amqpRPCClient) dispatch(channel *amqp.Channel, replies <-chan amqp.Delivery) {
+	for d := range replies {
+		rpc.mu.Lock()
+		call, ok := rpc.pending[d.CorrelationId]
+		delete(rpc.pending, d.CorrelationId)
+		rpc.mu.Unlock()
+
+		if ok {
+			call.reply <- d
+		}
+	}
+
+	rpc.mu.Lock()
+	for correlationID, call := range rpc.pending {
+		if call.channel == channel {
+			close(call.reply)
+			delete(rpc.pending, correlationID)
+		}
+	}
+	rpc.mu.Unlock()
+}
@@ -0,0 +1,625 @@
+// Copyright 2019 Luca Stasio <joshuagame@gmail.com>
+// Copyright 2019 IT Resources s.r.l.
+//
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package sgul defines common structures and functionalities for applications.
+// amqpsubscriber.go defines the AMQP Subscriber and its consuming lifecycle.
+package sgul
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// ErrNoEventHandler is returned when starting a subscriber with no registered event handler.
+var ErrNoEventHandler = errors.New("no event handler registered for subscriber")
+
+// ErrDeliverySettled is returned acking or nacking a delivery already acked or nacked,
+// a.e. a delivery requeued by Stop on drain timeout.
+var ErrDeliverySettled = errors.New("delivery already acked or nacked")
+
+// DefaultDrainTimeout is the default maximum wait time for in-flight events on subscriber Stop.
+const DefaultDrainTimeout = 30 * time.Second
+
+type (
+	// EventHandler is the func type to handle the events received by an AMQP Subscriber.
+	// If the handler returns nil the message is acked, otherwise it is nacked.
+	EventHandler func(ctx context.Context, event Event) error
+
+	// AMQPSubscriber define the AMQP Subscriber structure.
+	AMQPSubscriber struct {
+		Connection *AMQPConnection
+		Name       string
+		Queue      string
+		Consumer   string
+		AutoAck    bool
+		Exclusive  bool
+		NoLocal    bool
+		NoWait     bool
+		Replies    <-chan amqp.Delivery
+		// Prefetch is the subscriber channel QoS prefetch count (0 means no limit).
+		Prefetch int
+		// Workers is the number of goroutines handling events concurrently (1 if not set).
+		Workers int
+		// DrainTimeout is the maximum wait time for in-flight events on Stop.
+		DrainTimeout time.Duration
+		// MaxAttempts is the maximum number of delayed retries for a failed message
+		// (0 means no delayed retries: failed messages are requeued).
+		MaxAttempts int
+		// RetryDelays are the delays between retries: the last one is used for further attempts.
+		RetryDelays []time.Duration
+		// DeadLetterExchange receives failed messages after MaxAttempts retries and malformed messages.
+		DeadLetterExchange   string
+		DeadLetterRoutingKey string
+		// Dedup is the store used to skip already processed events (nil means no deduplication).
+		Dedup DedupStore
+
+		handler EventHandler
+
+		// dedicated consuming channel
+		channel *amqp.Channel
+		chMu    *sync.Mutex
+		// stop is closed to stop consuming
+		stop chan struct{}
+		// done is closed when all the worker goroutines end, that is when no delivery is in-flight
+		done chan struct{}
+		// inflight are the deliveries being handled, with their delivery tags
+		inflight map[*inflightAcknowledger]uint64
+		// cancel cancels the handlers context
+		cancel  context.CancelFunc
+		running bool
+		mu      *sync.Mutex
+	}
+)
+
+// NewSubscriber return a new AMQP Subscriber object initialized with "name"-subscriber configuration.
+// The subscriber queue must be declared in the AMQP configuration.
+func (conn *AMQPConnection) NewSubscriber(name string) (*AMQPSubscriber, error) {
+	if sub := conn.subscriber(name); sub != nil {
+		return sub, nil
+	}
+
+	// get subscriber configuration
+	s, ok := subscriberFor(conn.conf, name)
+	if !ok {
+		return nil, fmt.Errorf("no configuration found for subscriber '%s'", name)
+	}
+
+	var dedup DedupStore
+	if s.Dedup.Enabled {
+		dedup = NewMemoryDedupStore(s.Dedup.Size, s.Dedup.TTL)
+	}
+
+	return &AMQPSubscriber{
+		Connection:           conn,
+		Name:                 s.Name,
+		Queue:                s.Queue,
+		Consumer:             s.Name,
+		AutoAck:              s.NoAck,
+		Exclusive:            s.Exclusive,
+		NoLocal:              s.NoLocal,
+		NoWait:               s.NoWait,
+		Prefetch:             s.Prefetch,
+		Workers:              s.Workers,
+		DrainTimeout:         s.DrainTimeout,
+		MaxAttempts:          s.Retry.MaxAttempts,
+		RetryDelays:          s.Retry.Delays,
+		DeadLetterExchange:   s.Retry.DeadLetterExchange,
+		DeadLetterRoutingKey: s.Retry.DeadLetterRoutingKey,
+		Dedup:                dedup,
+		handler:              conn.handler(s.Name),
+		mu:                   &sync.Mutex{},
+		chMu:                 &sync.Mutex{},
+	}, nil
+}
+
+func subscriberFor(conf AMQP, name string) (Subscriber, bool) {
+	for _, subscriber := range conf.Subscribers {
+		if strings.ToLower(subscriber.Name) == strings.ToLower(name) {
+			return subscriber, true
+		}
+	}
+
+	// no subscriber configuration found for "name"
+	return Subscriber{}, false
+}
+
+func (conn *AMQPConnection) initSubscribers() error {
+	for _, s := range conn.conf.Subscribers {
+		if conn.subscriber(s.Name) == nil {
+			subscriber, err := conn.NewSubscriber(s.Name)
+			if err != nil {
+				return err
+			}
+			conn.mu.Lock()
+			if conn.Subscribers[s.Name] == nil {
+				conn.Subscribers[s.Name] = subscriber
+			}
+			conn.mu.Unlock()
+		}
+	}
+	return nil
+}
+
+// Subscriber reutrns a new AMQP Subscriber on this connection.
+func (conn *AMQPConnection) Subscriber(queue string, consumer string, durable, autoDelete, autoAck, exclusive, noLocal, noWait bool) (*AMQPSubscriber, error) {
+	return NewAMQPSubscriber(conn, queue, consumer, durable, autoDelete, autoAck, exclusive, noLocal, noWait)
+}
+
+// Handle registers the event handler for the "name"-subscriber.
+// Handlers can be registered before or after the connection is established.
+func (conn *AMQPConnection) Handle(name string, handler EventHandler) {
+	conn.mu.Lock()
+	conn.handlers[strings.ToLower(name)] = handler
+	conn.mu.Unlock()
+
+	for _, sub := range conn.subscribers() {
+		if strings.ToLower(sub.Name) == strings.ToLower(name) {
+			sub.Handle(handler)
+		}
+	}
+}
+
+// Start starts consuming for each subscriber with a registered event handler.
+func (conn *AMQPConnection) Start() error {
+	for _, sub := range conn.subscribers() {
+		if err := sub.Start(); err != nil && err != ErrNoEventHandler {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop gracefully stops all the running subscribers, concurrently.
+func (conn *AMQPConnection) Stop() error {
+	var err error
+	mu := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for _, sub := range conn.subscribers() {
+		wg.Add(1)
+		go func(sub *AMQPSubscriber) {
+			defer wg.Done()
+			if serr := sub.Stop(); serr != nil {
+				mu.Lock()
+				err = serr
+				mu.Unlock()
+			}
+		}(sub)
+	}
+	wg.Wait()
+	return err
+}
+
+// NewAMQPSubscriber returns a new AMQP Subscriber object.
+func NewAMQPSubscriber(connection *AMQPConnection, queue string, consumer string, durable, autoDelete, autoAck, exclusive, noLocal, noWait bool) (*AMQPSubscriber, error) {
+	q, err := connection.channel().QueueDeclare(
+		queue,
+		durable,
+		autoDelete,
+		exclusive,
+		noWait,
+		nil,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &AMQPSubscriber{
+		Connection: connection,
+		Queue:      q.Name,
+		Consumer:   consumer,
+		AutoAck:    autoAck,
+		Exclusive:  exclusive,
+		NoLocal:    noLocal,
+		NoWait:     noWait,
+		mu:         &sync.Mutex{},
+		chMu:       &sync.Mutex{},
+	}, nil
+}
+
+// Handle sets the subscriber event handler.
+func (sub *AMQPSubscriber) Handle(handler EventHandler) {
+	sub.mu.Lock()
+	sub.handler = handler
+	sub.mu.Unlock()
+}
+
+// Deduplicate sets the store used to skip already processed events.
+func (sub *AMQPSubscriber) Deduplicate(store DedupStore) {
+	sub.mu.Lock()
+	sub.Dedup = store
+	sub.mu.Unlock()
+}
+
+// Start starts consuming messages from queue, passing each event to the subscriber
+// event handler from Workers goroutines.
+func (sub *AMQPSubscriber) Start() error {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	if sub.running {
+		return nil
+	}
+	if sub.handler == nil {
+		return ErrNoEventHandler
+	}
+
+	replies, err := sub.Consume()
+	if err != nil {
+		return err
+	}
+
+	workers := sub.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	var ctx context.Context
+	ctx, sub.cancel = context.WithCancel(context.Background())
+	sub.done = make(chan struct{})
+	sub.inflight = make(map[*inflightAcknowledger]uint64)
+	sub.running = true
+
+	wg := &sync.WaitGroup{}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go sub.run(ctx, replies, sub.handler, wg)
+	}
+	go func(done chan struct{}) {
+		wg.Wait()
+		close(done)
+	}(sub.done)
+
+	return nil
+}
+
+// Stop gracefully stops the subscriber: it stops consuming, nacks and requeues the
+// deliveries not yet handled and waits for the in-flight events up to DrainTimeout.
+// The events still in-flight then are nacked and requeued (their handlers can no more ack them),
+// the handlers context is canceled and the subscriber channel is closed.
+func (sub *AMQPSubscriber) Stop() error {
+	sub.mu.Lock()
+	if !sub.running {
+		sub.mu.Unlock()
+		return nil
+	}
+	sub.running = false
+	done, cancel := sub.done, sub.cancel
+	sub.mu.Unlock()
+
+	sub.chMu.Lock()
+	channel := sub.channel
+	sub.chMu.Unlock()
+
+	err := channel.Cancel(sub.Consumer, false)
+	if err == amqp.ErrClosed {
+		err = nil
+	}
+
+	sub.mu.Lock()
+	if sub.stop != nil {
+		close(sub.stop)
+		sub.stop = nil
+	}
+	sub.mu.Unlock()
+
+	timeout := sub.DrainTimeout
+	if timeout <= 0 {
+		timeout = DefaultDrainTimeout
+	}
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("subscriber %s: drain timeout expired, requeueing in-flight events", sub.Name)
+		sub.requeueInflight()
+	}
+	cancel()
+
+	// consuming could have been restarted on a new channel in the meantime
+	sub.chMu.Lock()
+	sub.channel.Close()
+	sub.chMu.Unlock()
+
+	return err
+}
+
+// run is a worker passing each delivery to the event handler, till the replies channel is closed.
+func (sub *AMQPSubscriber) run(ctx context.Context, replies <-chan amqp.Delivery, handler EventHandler, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for d := range replies {
+		if sub.AutoAck {
+			sub.handle(ctx, handler, d)
+			continue
+		}
+
+		ack := sub.track(&d)
+		sub.handle(ctx, handler, d)
+		sub.untrack(ack)
+	}
+}
+
+// inflightAcknowledger acks or nacks a delivery at most once, so that Stop can requeue
+// the in-flight deliveries on drain timeout without their handlers acking them later.
+type inflightAcknowledger struct {
+	amqp.Acknowledger
+	mu      sync.Mutex
+	settled bool
+}
+
+// settle marks the delivery as acked or nacked. It returns false if it already was.
+func (a *inflightAcknowledger) settle() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.settled {
+		return false
+	}
+	a.settled = true
+	return true
+}
+
+// Ack acks the delivery if not already acked or nacked.
+func (a *inflightAcknowledger) Ack(tag uint64, multiple bool) error {
+	if !a.settle() {
+		return ErrDeliverySettled
+	}
+	return a.Acknowledger.Ack(tag, multiple)
+}
+
+// Nack nacks the delivery if not already acked or nacked.
+func (a *inflightAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	if !a.settle() {
+		return ErrDeliverySettled
+	}
+	return a.Acknowledger.Nack(tag, multiple, requeue)
+}
+
+// Reject rejects the delivery if not already acked or nacked.
+func (a *inflightAcknowledger) Reject(tag uint64, requeue bool) error {
+	if !a.settle() {
+		return ErrDeliverySettled
+	}
+	return a.Acknowledger.Reject(tag, requeue)
+}
+
+// track adds the delivery to the in-flight ones, acking and nacking it through an inflightAcknowledger.
+func (sub *AMQPSubscriber) track(d *amqp.Delivery) *inflightAcknowledger {
+	ack := &inflightAcknowledger{Acknowledger: d.Acknowledger}
+	d.Acknowledger = ack
+
+	sub.mu.Lock()
+	sub.inflight[ack] = d.DeliveryTag
+	sub.mu.Unlock()
+	return ack
+}
+
+// untrack removes a handled delivery from the in-flight ones.
+func (sub *AMQPSubscriber) untrack(ack *inflightAcknowledger) {
+	sub.mu.Lock()
+	delete(sub.inflight, ack)
+	sub.mu.Unlock()
+}
+
+// requeueInflight nacks and requeues the in-flight deliveries not yet acked or nacked by their handlers.
+func (sub *AMQPSubscriber) requeueInflight() {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	for ack, tag := range sub.inflight {
+		if ack.settle() {
+			if err := ack.Acknowledger.Nack(tag, false, true); err != nil {
+				log.Printf("subscriber %s: unable to requeue in-flight message: %s", sub.Name, err)
+			}
+		}
+	}
+}
+
+// handle decodes the delivery into an Event and calls the event handler.
+// The delivery is acked if the handler succeeds, otherwise it is retried with delay
+// (or nacked and requeued if the subscriber has no retries or the retry fails).
+// Older event versions are upcasted to the current one.
+// Malformed messages, unknown events and invalid payloads are dead-lettered,
+// already processed events are acked and skipped.
+func (sub *AMQPSubscriber) handle(ctx context.Context, handler EventHandler, d amqp.Delivery) {
+	event, err := decodeEvent(d)
+	if err != nil {
+		log.Printf("subscriber %s: unable to decode message from queue %s: %s", sub.Name, sub.Queue, err)
+		if !sub.AutoAck {
+			if derr := sub.deadLetter(d, err); derr != nil {
+				log.Printf("subscriber %s: unable to dead-letter message: %s", sub.Name, derr)
+			}
+		}
+		return
+	}
+	if event.ID == "" {
+		// events published before IDs were introduced
+		event.ID = d.MessageId
+	}
+	if event, err = Upcast(event); err != nil {
+		log.Printf("subscriber %s: unable to upcast event %s: %s", sub.Name, event.Name, err)
+		if !sub.AutoAck {
+			if derr := sub.deadLetter(d, err); derr != nil {
+				log.Printf("subscriber %s: unable to dead-letter message: %s", sub.Name, derr)
+			}
+		}
+		return
+	}
+
+	if err := sub.process(context.WithValue(ctx, ctxDeliveryKey, d), handler, event); err != nil {
+		if err == ErrDuplicateEvent {
+			log.Printf("subscriber %s: skipping duplicate event %s (%s)", sub.Name, event.Name, event.ID)
+			if !sub.AutoAck {
+				d.Ack(false)
+			}
+			return
+		}
+		log.Printf("subscriber %s: error handling event %s: %s", sub.Name, event.Name, err)
+		if sub.AutoAck {
+			return
+		}
+		if unprocessable(err) {
+			if derr := sub.deadLetter(d, err); derr != nil {
+				log.Printf("subscriber %s: unable to dead-letter event %s: %s", sub.Name, event.Name, derr)
+			}
+			return
+		}
+		if sub.MaxAttempts <= 0 {
+			d.Nack(false, true)
+			return
+		}
+		if rerr := sub.retry(d, err); rerr != nil {
+			log.Printf("subscriber %s: unable to retry event %s: %s", sub.Name, event.Name, rerr)
+		}
+		return
+	}
+
+	if !sub.AutoAck {
+		d.Ack(false)
+	}
+}
+
+// process calls the event handler, through the deduplication store if any.
+func (sub *AMQPSubscriber) process(ctx context.Context, handler EventHandler, event Event) error {
+	sub.mu.Lock()
+	dedup := sub.Dedup
+	sub.mu.Unlock()
+
+	if dedup == nil || event.ID == "" {
+		return handler(ctx, event)
+	}
+	return dedup.Process(ctx, sub.Name, event.ID, func(ctx context.Context) error {
+		return handler(ctx, event)
+	})
+}
+
+// Consume start consuming messages from queue on a dedicated channel. Returns outputs channel to range on.
+// The returned channel survives reconnections: consuming is restarted as soon as
+// the connection is recovered. It is closed when the connection is closed.
+func (sub *AMQPSubscriber) Consume() (<-chan amqp.Delivery, error) {
+	if sub.Consumer == "" {
+		// a consumer tag is needed to cancel the consumer
+		sub.Consumer = fmt.Sprintf("%s-%d", sub.Queue, time.Now().UnixNano())
+	}
+
+	deliveries, err := sub.consume()
+	if err != nil {
+		return nil, err
+	}
+
+	replies := make(chan amqp.Delivery)
+	sub.Replies = replies
+	sub.stop = make(chan struct{})
+
+	go sub.forward(deliveries, replies, sub.stop)
+
+	return replies, nil
+}
+
+// consume opens a dedicated channel on the current connection and starts consuming on it.
+func (sub *AMQPSubscriber) consume() (<-chan amqp.Delivery, error) {
+	sub.Connection.mu.RLock()
+	connection := sub.Connection.Connection
+	sub.Connection.mu.RUnlock()
+	if connection == nil {
+		return nil, amqp.ErrClosed
+	}
+
+	channel, err := connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	if sub.Prefetch > 0 {
+		if err := channel.Qos(sub.Prefetch, 0, false); err != nil {
+			channel.Close()
+			return nil, err
+		}
+	}
+
+	deliveries, err := channel.Consume(
+		sub.Queue,
+		sub.Consumer,
+		sub.AutoAck,
+		sub.Exclusive,
+		sub.NoLocal,
+		sub.NoWait,
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		return nil, err
+	}
+
+	sub.chMu.Lock()
+	sub.channel = channel
+	sub.chMu.Unlock()
+
+	return deliveries, nil
+}
+
+// forward forwards deliveries to the subscriber replies channel.
+// When the deliveries channel is closed (the subscriber channel or the whole connection is lost)
+// consuming is restarted, with backoff, as soon as the connection is up again.
+func (sub *AMQPSubscriber) forward(deliveries <-chan amqp.Delivery, replies chan amqp.Delivery, stop chan struct{}) {
+	defer close(replies)
+	for {
+		for d := range deliveries {
+			select {
+			case replies <- d:
+			case <-stop:
+				sub.requeue(d, deliveries)
+				return
+			}
+		}
+
+		for attempt := 1; ; attempt++ {
+			select {
+			case <-stop:
+				return
+			case <-sub.Connection.closed:
+				return
+			case <-time.After(sub.Connection.backoff.Duration(attempt)):
+			}
+
+			if sub.Connection.State() != AMQPConnected {
+				continue
+			}
+
+			var err error
+			if deliveries, err = sub.consume(); err == nil {
+				break
+			}
+			log.Printf("subscriber %s: unable to restart consuming from queue %s: %s", sub.Name, sub.Queue, err)
+		}
+	}
+}
+
+// requeue nacks and requeues the delivery and the deliveries already received, not yet handled.
+func (sub *AMQPSubscriber) requeue(d amqp.Delivery, deliveries <-chan amqp.Delivery) {
+	if sub.AutoAck {
+		// already acked: nothing to requeue
+		return
+	}
+
+	d.Nack(false, true)
+	for {
+		select {
+		case d, ok := <-deliveries:
+			if !ok {
+				return
+			}
+			d.Nack(false, true)
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2019 Luca Stasio <joshuagame@gmail.com>
+// Copyright 2019 IT Resources s.r.l.
+//
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package sgul
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+// recordingAcknowledger records the acks and nacks of deliveries.
+type recordingAcknowledger struct {
+	mu    sync.Mutex
+	acks  []uint64
+	nacks []uint64
+}
+
+func (a *recordingAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.acks = append(a.acks, tag)
+	return nil
+}
+
+func (a *recordingAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if requeue {
+		a.nacks = append(a.nacks, tag)
+	}
+	return nil
+}
+
+func (a *recordingAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+func TestAMQPSubscriberRequeueInflight(t *testing.T) {
+	acknowledger := &recordingAcknowledger{}
+	sub := &AMQPSubscriber{
+		Name:     "orders",
+		mu:       &sync.Mutex{},
+		inflight: make(map[*inflightAcknowledger]uint64),
+	}
+
+	handled := amqp.Delivery{Acknowledger: acknowledger, DeliveryTag: 1}
+	sub.untrack(sub.track(&handled))
+	if err := handled.Ack(false); err != nil {
+		t.Fatal(err)
+	}
+
+	slow := amqp.Delivery{Acknowledger: acknowledger, DeliveryTag: 2}
+	sub.track(&slow)
+	sub.requeueInflight()
+
+	// the handler ends after the drain timeout
+	if err := slow.Ack(false); err != ErrDeliverySettled {
+		t.Errorf("ack after requeue: got error %v, want %v", err, ErrDeliverySettled)
+	}
+
+	if len(acknowledger.acks) != 1 || acknowledger.acks[0] != 1 {
+		t.Errorf("acked deliveries = %v, want [1]", acknowledger.acks)
+	}
+	if len(acknowledger.nacks) != 1 || acknowledger.nacks[0] != 2 {
+		t.Errorf("requeued deliveries = %v, want [2]", acknowledger.nacks)
+	}
+}
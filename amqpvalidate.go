@@ -0,0 +1,304 @@
+// Copyright 2019 Luca Stasio <joshuagame@gmail.com>
+// Copyright 2019 IT Resources s.r.l.
+//
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package sgul defines common structures and functionalities for applications.
+// amqpvalidate.go defines the AMQP configuration validation and the topology dry-run.
+package sgul
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/streadway/amqp"
+)
+
+// ErrAMQPDryRun is returned by Connect in dry-run mode, once the topology report has been logged.
+var ErrAMQPDryRun = errors.New("amqp dry-run: topology not declared")
+
+type (
+	// AMQPConfigError reports all the problems found in the AMQP configuration.
+	AMQPConfigError struct {
+		Problems []string
+	}
+
+	// AMQPTopologyReport is the difference between the configured topology and the broker one.
+	// Bindings and server-named queues are not checked.
+	AMQPTopologyReport struct {
+		// MissingExchanges are the configured exchanges not declared on the broker.
+		MissingExchanges []string
+		// MissingQueues are the configured queues (and subscribers retry queues) not declared on the broker.
+		MissingQueues []string
+		// Mismatches are the configured exchanges and queues declared on the broker
+		// with different properties or arguments, with the broker reason.
+		Mismatches []string
+		// Errors are the exchanges and queues that could not be checked, with the error.
+		Errors []string
+		// Queues are the configured queues already declared on the broker.
+		Queues []amqp.Queue
+	}
+
+	// amqpQueueCheck is a queue declaration checked by DryRun.
+	amqpQueueCheck struct {
+		name       string
+		durable    bool
+		autoDelete bool
+		exclusive  bool
+		args       amqp.Table
+	}
+)
+
+func (e *AMQPConfigError) Error() string {
+	return "invalid amqp configuration: " + strings.Join(e.Problems, "; ")
+}
+
+// InSync checks if all the configured exchanges and queues are declared on the broker, as configured.
+func (r AMQPTopologyReport) InSync() bool {
+	return len(r.MissingExchanges) == 0 && len(r.MissingQueues) == 0 && len(r.Mismatches) == 0 && len(r.Errors) == 0
+}
+
+// String returns the report description.
+func (r AMQPTopologyReport) String() string {
+	lines := []string{}
+	for _, exchange := range r.MissingExchanges {
+		lines = append(lines, fmt.Sprintf("+ exchange %s", exchange))
+	}
+	for _, queue := range r.MissingQueues {
+		lines = append(lines, fmt.Sprintf("+ queue %s", queue))
+	}
+	for _, mismatch := range r.Mismatches {
+		lines = append(lines, fmt.Sprintf("~ %s", mismatch))
+	}
+	for _, err := range r.Errors {
+		lines = append(lines, fmt.Sprintf("! %s", err))
+	}
+	for _, queue := range r.Queues {
+		lines = append(lines, fmt.Sprintf("= queue %s (%d messages, %d consumers)", queue.Name, queue.Messages, queue.Consumers))
+	}
+	if r.InSync() {
+		lines = append(lines, "topology in sync")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ValidateAMQPConfig checks the AMQP configuration consistency: names must be unique
+// (queues with empty name are server-named), publishers, bindings and dead letter settings must reference declared exchanges
+// (or the default and "amq." ones) and subscribers and bindings must reference declared queues.
+// It returns an *AMQPConfigError with all the problems found.
+func ValidateAMQPConfig(conf AMQP) error {
+	problems := []string{}
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	exchanges := map[string]bool{}
+	for _, exchange := range conf.Exchanges {
+		if exchange.Name == "" {
+			problem("exchange with empty name")
+			continue
+		}
+		if exchanges[exchange.Name] {
+			problem("duplicate exchange '%s'", exchange.Name)
+		}
+		exchanges[exchange.Name] = true
+	}
+	exchangeDeclared := func(name string) bool {
+		return name == "" || exchanges[name] || strings.HasPrefix(name, "amq.")
+	}
+
+	queues := map[string]bool{}
+	for _, queue := range conf.Queues {
+		if queue.Name == "" {
+			if !exchangeDeclared(queue.DeadLetterExchange) {
+				problem("server-named queue: undeclared dead letter exchange '%s'", queue.DeadLetterExchange)
+			}
+			continue
+		}
+		if queues[queue.Name] {
+			problem("duplicate queue '%s'", queue.Name)
+		}
+		queues[queue.Name] = true
+		if !exchangeDeclared(queue.DeadLetterExchange) {
+			problem("queue '%s': undeclared dead letter exchange '%s'", queue.Name, queue.DeadLetterExchange)
+		}
+	}
+
+	for _, binding := range conf.Bindings {
+		if binding.Exchange == "" || !exchangeDeclared(binding.Exchange) {
+			problem("binding: undeclared exchange '%s'", binding.Exchange)
+		}
+		switch {
+		case binding.Queue != "":
+			if !queues[binding.Queue] {
+				problem("binding to exchange '%s': undeclared queue '%s'", binding.Exchange, binding.Queue)
+			}
+		case binding.Destination != "":
+			if !exchangeDeclared(binding.Destination) {
+				problem("binding to exchange '%s': undeclared destination exchange '%s'", binding.Exchange, binding.Destination)
+			}
+		default:
+			problem("binding to exchange '%s' has no queue nor destination exchange", binding.Exchange)
+		}
+	}
+
+	publishers := map[string]bool{}
+	for _, publisher := range conf.Publishers {
+		name := strings.ToLower(publisher.Name)
+		if name == "" {
+			problem("publisher with empty name")
+		} else if publishers[name] {
+			problem("duplicate publisher '%s'", publisher.Name)
+		}
+		publishers[name] = true
+
+		if !exchangeDeclared(publisher.Exchange) {
+			problem("publisher '%s': undeclared exchange '%s'", publisher.Name, publisher.Exchange)
+		}
+		switch strings.ToLower(publisher.Format) {
+		case "", EventFormatSgul, EventFormatStructured, EventFormatBinary:
+		default:
+			problem("publisher '%s': unknown format '%s'", publisher.Name, publisher.Format)
+		}
+		switch strings.ToLower(publisher.Buffer.Type) {
+		case "", PublishBufferMemory:
+		case PublishBufferDisk:
+			if publisher.Buffer.Dir == "" {
+				problem("publisher '%s': missing disk buffer directory", publisher.Name)
+			}
+		default:
+			problem("publisher '%s': unknown buffer type '%s'", publisher.Name, publisher.Buffer.Type)
+		}
+	}
+
+	subscribers := map[string]bool{}
+	for _, subscriber := range conf.Subscribers {
+		name := strings.ToLower(subscriber.Name)
+		if name == "" {
+			problem("subscriber with empty name")
+		} else if subscribers[name] {
+			problem("duplicate subscriber '%s'", subscriber.Name)
+		}
+		subscribers[name] = true
+
+		if !queues[subscriber.Queue] {
+			problem("subscriber '%s': undeclared queue '%s'", subscriber.Name, subscriber.Queue)
+		}
+		if !exchangeDeclared(subscriber.Retry.DeadLetterExchange) {
+			problem("subscriber '%s': undeclared dead letter exchange '%s'", subscriber.Name, subscriber.Retry.DeadLetterExchange)
+		}
+	}
+
+	if len(problems) > 0 {
+		return &AMQPConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// DryRun connects to the AMQP server and checks, with passive declares, which of the configured
+// exchanges and queues are already declared on the broker. Those already declared are declared
+// again as configured, which the broker refuses if their properties or arguments differ.
+// Nothing new is declared. Failed checks are reported by entity.
+func (conn *AMQPConnection) DryRun() (AMQPTopologyReport, error) {
+	report := AMQPTopologyReport{}
+
+	connection, err := conn.dial()
+	if err != nil {
+		return report, err
+	}
+	defer connection.Close()
+
+	// a failed declare closes the channel: each declare needs its own channel
+	declare := func(declare func(ch *amqp.Channel) error) error {
+		ch, err := connection.Channel()
+		if err != nil {
+			return err
+		}
+		defer ch.Close()
+		return declare(ch)
+	}
+	// check reports the result of the passive declare and of the declare as configured
+	check := func(entity string, passive func(ch *amqp.Channel) error, active func(ch *amqp.Channel) error) bool {
+		err := declare(passive)
+		if err == nil {
+			err = declare(active)
+			if amqpErr, ok := err.(*amqp.Error); ok && amqpErr.Code == amqp.PreconditionFailed {
+				report.Mismatches = append(report.Mismatches, fmt.Sprintf("%s: %s", entity, amqpErr.Reason))
+				return true
+			}
+		} else if amqpErr, ok := err.(*amqp.Error); ok && amqpErr.Code == amqp.NotFound {
+			return false
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", entity, err))
+		}
+		return true
+	}
+
+	for _, exchange := range conn.conf.Exchanges {
+		args, err := exchangeArgs(exchange)
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+
+		found := check("exchange "+exchange.Name, func(ch *amqp.Channel) error {
+			return ch.ExchangeDeclarePassive(exchange.Name, exchange.Type, exchange.Durable, exchange.AutoDelete, exchange.Internal, false, args)
+		}, func(ch *amqp.Channel) error {
+			return ch.ExchangeDeclare(exchange.Name, exchange.Type, exchange.Durable, exchange.AutoDelete, exchange.Internal, false, args)
+		})
+		if !found {
+			report.MissingExchanges = append(report.MissingExchanges, exchange.Name)
+		}
+	}
+
+	queues := []amqpQueueCheck{}
+	for _, queue := range conn.conf.Queues {
+		if queue.Name == "" {
+			continue
+		}
+		args, err := queueArgs(queue)
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+		queues = append(queues, amqpQueueCheck{queue.Name, queue.Durable, queue.AutoDelete, queue.Exclusive, args})
+	}
+	for _, s := range conn.conf.Subscribers {
+		if s.Retry.MaxAttempts <= 0 {
+			continue
+		}
+		sub := AMQPSubscriber{RetryDelays: s.Retry.Delays}
+		for _, delay := range sub.retryDelays() {
+			queues = append(queues, amqpQueueCheck{retryQueueName(s.Queue, delay), true, false, false, retryQueueArgs(s.Queue, delay)})
+		}
+	}
+
+	checked := map[string]bool{}
+	for _, queue := range queues {
+		if checked[queue.name] {
+			continue
+		}
+		checked[queue.name] = true
+
+		var q amqp.Queue
+		found := check("queue "+queue.name, func(ch *amqp.Channel) error {
+			var err error
+			q, err = ch.QueueDeclarePassive(queue.name, queue.durable, queue.autoDelete, queue.exclusive, false, queue.args)
+			return err
+		}, func(ch *amqp.Channel) error {
+			_, err := ch.QueueDeclare(queue.name, queue.durable, queue.autoDelete, queue.exclusive, false, queue.args)
+			return err
+		})
+		switch {
+		case !found:
+			report.MissingQueues = append(report.MissingQueues, queue.name)
+		case q.Name != "":
+			report.Queues = append(report.Queues, q)
+		}
+	}
+
+	return report, nil
+}
@@ -0,0 +1,81 @@
+// Package backoff defines the exponential backoff policy used between retries
+// (a.e. service registrations and broker reconnections).
+package backoff
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Policy defines an exponential backoff policy used between two retries.
+type Policy struct {
+	// InitialInterval is the wait time before the first retry.
+	InitialInterval time.Duration
+	// MaxInterval caps the wait time between two retries.
+	MaxInterval time.Duration
+	// Multiplier is the factor used to grow the interval at each retry.
+	Multiplier float64
+	// Jitter is the randomization factor (0..1, higher values are clamped to 1) applied to each interval,
+	// so that many instances restarting together do not hit the server at once.
+	Jitter float64
+	// NoJitter disables the jitter: a zero Jitter is otherwise taken from the defaults on Merge.
+	NoJitter bool
+}
+
+// Default is the default backoff policy.
+var Default = Policy{
+	InitialInterval: 2 * time.Second,
+	MaxInterval:     1 * time.Minute,
+	Multiplier:      2,
+	Jitter:          0.2,
+}
+
+// Merge returns the policy with its unset (zero) values taken from the defaults policy.
+// The jitter is unset only if NoJitter is false. A Multiplier of 1 gives a constant interval.
+func (p Policy) Merge(defaults Policy) Policy {
+	if p.InitialInterval <= 0 {
+		p.InitialInterval = defaults.InitialInterval
+	}
+	if p.MaxInterval <= 0 {
+		p.MaxInterval = defaults.MaxInterval
+	}
+	if p.Multiplier <= 0 {
+		p.Multiplier = defaults.Multiplier
+	}
+	if p.NoJitter {
+		p.Jitter = 0
+	} else if p.Jitter <= 0 {
+		p.Jitter = defaults.Jitter
+	}
+	return p
+}
+
+// Duration returns the wait time before the n-th retry (starting from 1).
+// The jittered interval never exceeds MaxInterval.
+func (p Policy) Duration(attempt int) time.Duration {
+	if p.InitialInterval <= 0 {
+		p.InitialInterval = Default.InitialInterval
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = 1
+	}
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	interval := float64(p.InitialInterval) * math.Pow(p.Multiplier, float64(attempt-1))
+	if p.MaxInterval > 0 && interval > float64(p.MaxInterval) {
+		interval = float64(p.MaxInterval)
+	}
+
+	if p.Jitter > 0 {
+		delta := math.Min(p.Jitter, 1) * interval
+		interval = interval - delta + rand.Float64()*(2*delta)
+		if p.MaxInterval > 0 && interval > float64(p.MaxInterval) {
+			interval = float64(p.MaxInterval)
+		}
+	}
+
+	return time.Duration(interval)
+}
@@ -0,0 +1,50 @@
+package backoff
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+		want   Policy
+	}{
+		{"unset", Policy{}, Default},
+		{"set", Policy{InitialInterval: time.Second, MaxInterval: time.Second, Multiplier: 1, Jitter: 0.5}, Policy{InitialInterval: time.Second, MaxInterval: time.Second, Multiplier: 1, Jitter: 0.5}},
+		{"no jitter", Policy{NoJitter: true}, Policy{InitialInterval: Default.InitialInterval, MaxInterval: Default.MaxInterval, Multiplier: Default.Multiplier, NoJitter: true}},
+		{"no jitter overrides jitter", Policy{Jitter: 0.5, NoJitter: true}, Policy{InitialInterval: Default.InitialInterval, MaxInterval: Default.MaxInterval, Multiplier: Default.Multiplier, NoJitter: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Merge(Default); got != tt.want {
+				t.Errorf("Merge() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDurationWithoutJitter(t *testing.T) {
+	p := Policy{InitialInterval: 100 * time.Millisecond, MaxInterval: time.Second, Multiplier: 2, Jitter: 0, NoJitter: true}.Merge(Default)
+
+	want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+	for i, w := range want {
+		// the same duration on each call
+		for n := 0; n < 10; n++ {
+			if got := p.Duration(i + 1); got != w {
+				t.Fatalf("Duration(%d) = %s, want %s", i+1, got, w)
+			}
+		}
+	}
+}
+
+func TestDurationJitter(t *testing.T) {
+	p := Policy{InitialInterval: time.Second, MaxInterval: time.Minute, Multiplier: 2, Jitter: 0.5}
+	for n := 0; n < 100; n++ {
+		if got := p.Duration(2); got < time.Second || got > 3*time.Second {
+			t.Fatalf("Duration(2) = %s, want within [1s, 3s]", got)
+		}
+	}
+}
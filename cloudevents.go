@@ -0,0 +1,290 @@
+// Copyright 2019 Luca Stasio <joshuagame@gmail.com>
+// Copyright 2019 IT Resources s.r.l.
+//
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package sgul defines common structures and functionalities for applications.
+// cloudevents.go defines the CloudEvents representation of events and their AMQP encoding.
+package sgul
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// CloudEvents specification constants.
+const (
+	CloudEventsSpecVersion = "1.0"
+	CloudEventsContentType = "application/cloudevents+json"
+	// cloudEventsHeaderPrefix is the AMQP binding prefix for attributes in binary mode.
+	cloudEventsHeaderPrefix = "cloudEvents_"
+)
+
+// Event wire formats.
+const (
+	// EventFormatSgul is the sgul Event json format.
+	EventFormatSgul = "sgul"
+	// EventFormatStructured is the CloudEvents structured mode: the whole CloudEvent in the message body.
+	EventFormatStructured = "structured"
+	// EventFormatBinary is the CloudEvents binary mode: attributes in AMQP headers, data in the message body.
+	EventFormatBinary = "binary"
+)
+
+// CloudEvent is the CloudEvents 1.0 json representation of an Event.
+// Correlation and causation IDs and tenant are carried as extension attributes.
+type CloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            *time.Time      `json:"time,omitempty"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	// DataBase64 is the data for non-json content types
+	DataBase64 []byte `json:"data_base64,omitempty"`
+	// extension attributes
+	Name          string `json:"name,omitempty"`
+	Version       int    `json:"version,omitempty"`
+	CorrelationID string `json:"correlationid,omitempty"`
+	CausationID   string `json:"causationid,omitempty"`
+	Tenant        string `json:"tenant,omitempty"`
+}
+
+// CloudEvent returns the CloudEvents representation of the event.
+// The CloudEvent type is the event Type, or its Name if Type is empty.
+// The payload is marshaled with the codec for the event DataContentType (json if empty).
+func (e Event) CloudEvent() (CloudEvent, error) {
+	ce := CloudEvent{
+		SpecVersion:     e.SpecVersion,
+		ID:              e.ID,
+		Source:          e.Source,
+		Type:            e.Type,
+		Subject:         e.Subject,
+		DataContentType: e.DataContentType,
+		CorrelationID:   e.CorrelationID,
+		CausationID:     e.CausationID,
+		Tenant:          e.Tenant,
+		Version:         e.Version,
+	}
+	if ce.SpecVersion == "" {
+		ce.SpecVersion = CloudEventsSpecVersion
+	}
+	if ce.ID == "" {
+		ce.ID = newUUID()
+	}
+	if ce.Type == "" {
+		ce.Type = e.Name
+	} else if e.Name != e.Type {
+		ce.Name = e.Name
+	}
+	if !e.Time.IsZero() {
+		t := e.Time
+		ce.Time = &t
+	}
+	if e.Payload != nil {
+		if ce.DataContentType == "" {
+			ce.DataContentType = ContentTypeJSON
+		}
+		data, err := CodecFor(ce.DataContentType).Marshal(e.Payload)
+		if err != nil {
+			return CloudEvent{}, err
+		}
+		ce.setData(data)
+	}
+	return ce, nil
+}
+
+// Event returns the sgul Event for the CloudEvent.
+func (ce CloudEvent) Event() (Event, error) {
+	e := Event{
+		ID:              ce.ID,
+		Name:            ce.Name,
+		Source:          ce.Source,
+		Type:            ce.Type,
+		SpecVersion:     ce.SpecVersion,
+		Subject:         ce.Subject,
+		DataContentType: ce.DataContentType,
+		CorrelationID:   ce.CorrelationID,
+		CausationID:     ce.CausationID,
+		Tenant:          ce.Tenant,
+		Version:         ce.Version,
+	}
+	if e.Name == "" {
+		e.Name = ce.Type
+	}
+	if ce.Time != nil {
+		e.Time = *ce.Time
+	}
+	if data := ce.data(); len(data) > 0 {
+		if err := CodecFor(ce.DataContentType).Unmarshal(data, &e.Payload); err != nil {
+			return Event{}, err
+		}
+	}
+	return e, nil
+}
+
+// setData sets the CloudEvent data: as json for json content types, base64 encoded otherwise.
+func (ce *CloudEvent) setData(data []byte) {
+	if isJSON(ce.DataContentType) {
+		ce.Data = data
+	} else {
+		ce.DataBase64 = data
+	}
+}
+
+// data returns the CloudEvent data, whatever its content type.
+func (ce CloudEvent) data() []byte {
+	if len(ce.Data) > 0 {
+		return ce.Data
+	}
+	return ce.DataBase64
+}
+
+// encodeEvent sets the message body (and headers and content type for CloudEvents formats)
+// for the event in the wire format, using the codec for the message content type.
+// The body is then compressed for the message content encoding, if any.
+// Unversioned events are published with the event current version, so that
+// they are not upcasted by consumers.
+func encodeEvent(format string, event Event, msg *amqp.Publishing) error {
+	var err error
+	if event.Version == 0 {
+		event.Version = CurrentVersion(event.Name)
+	}
+	format = strings.ToLower(format)
+	if (format == EventFormatStructured || format == EventFormatBinary) && event.DataContentType == "" {
+		// CloudEvents formats encode the payload with the message content type codec
+		event.DataContentType = msg.ContentType
+	}
+
+	switch format {
+	case "", EventFormatSgul:
+		if msg.Body, err = CodecFor(msg.ContentType).Marshal(event); err != nil {
+			return err
+		}
+	case EventFormatStructured:
+		ce, err := event.CloudEvent()
+		if err != nil {
+			return err
+		}
+		if msg.Body, err = json.Marshal(ce); err != nil {
+			return err
+		}
+		msg.ContentType = CloudEventsContentType
+	case EventFormatBinary:
+		ce, err := event.CloudEvent()
+		if err != nil {
+			return err
+		}
+		if msg.Headers == nil {
+			msg.Headers = amqp.Table{}
+		}
+		for attr, value := range cloudEventHeaders(ce) {
+			msg.Headers[cloudEventsHeaderPrefix+attr] = value
+		}
+		msg.ContentType = ce.DataContentType
+		msg.Body = ce.data()
+	default:
+		return fmt.Errorf("unknown event format '%s'", format)
+	}
+
+	msg.Body, err = compress(msg.ContentEncoding, msg.Body)
+	return err
+}
+
+// cloudEventHeaders returns the non-empty CloudEvent attributes, except data and datacontenttype.
+func cloudEventHeaders(ce CloudEvent) map[string]string {
+	headers := map[string]string{
+		"specversion":   ce.SpecVersion,
+		"id":            ce.ID,
+		"source":        ce.Source,
+		"type":          ce.Type,
+		"subject":       ce.Subject,
+		"name":          ce.Name,
+		"correlationid": ce.CorrelationID,
+		"causationid":   ce.CausationID,
+		"tenant":        ce.Tenant,
+	}
+	if ce.Version != 0 {
+		headers["version"] = strconv.Itoa(ce.Version)
+	}
+	if ce.Time != nil {
+		headers["time"] = ce.Time.Format(time.RFC3339Nano)
+	}
+	for attr, value := range headers {
+		if value == "" {
+			delete(headers, attr)
+		}
+	}
+	return headers
+}
+
+// deliveryFormat detects the wire format of a delivered message.
+func deliveryFormat(d amqp.Delivery) string {
+	if strings.HasPrefix(d.ContentType, CloudEventsContentType) {
+		return EventFormatStructured
+	}
+	if _, ok := d.Headers[cloudEventsHeaderPrefix+"specversion"]; ok {
+		return EventFormatBinary
+	}
+	return EventFormatSgul
+}
+
+// decodeEvent decodes the delivered message into an Event, according to its wire format,
+// using the codec for the message content type (after decompressing it for its content encoding).
+func decodeEvent(d amqp.Delivery) (Event, error) {
+	body, err := decompress(d.ContentEncoding, d.Body)
+	if err != nil {
+		return Event{}, err
+	}
+
+	var event Event
+	switch deliveryFormat(d) {
+	case EventFormatStructured:
+		var ce CloudEvent
+		if err := json.Unmarshal(body, &ce); err != nil {
+			return Event{}, err
+		}
+		return ce.Event()
+	case EventFormatBinary:
+		ce := CloudEvent{DataContentType: d.ContentType}
+		ce.setData(body)
+		header := func(attr string) string {
+			value, _ := d.Headers[cloudEventsHeaderPrefix+attr].(string)
+			return value
+		}
+		ce.SpecVersion = header("specversion")
+		ce.ID = header("id")
+		ce.Source = header("source")
+		ce.Type = header("type")
+		ce.Subject = header("subject")
+		ce.Name = header("name")
+		ce.CorrelationID = header("correlationid")
+		ce.CausationID = header("causationid")
+		ce.Tenant = header("tenant")
+		if value := header("version"); value != "" {
+			version, err := strconv.Atoi(value)
+			if err != nil {
+				return Event{}, err
+			}
+			ce.Version = version
+		}
+		if value := header("time"); value != "" {
+			t, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				return Event{}, err
+			}
+			ce.Time = &t
+		}
+		return ce.Event()
+	default:
+		err := CodecFor(d.ContentType).Unmarshal(body, &event)
+		return event, err
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright 2019 Luca Stasio <joshuagame@gmail.com>
+// Copyright 2019 IT Resources s.r.l.
+//
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package sgul defines common structures and functionalities for applications.
+// codec.go defines the events codecs registry, keyed by content type, and the content encodings.
+package sgul
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/vmihailenco/msgpack"
+)
+
+// Supported content types and encodings.
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeMsgPack  = "application/msgpack"
+	ContentTypeProtobuf = "application/protobuf"
+	ContentEncodingGzip = "gzip"
+)
+
+// ErrNotProtoMessage is returned by the protobuf codec for values that are not protobuf messages.
+var ErrNotProtoMessage = errors.New("value is not a protobuf message")
+
+type (
+	// Codec marshals and unmarshals events and payloads for a content type.
+	Codec interface {
+		Marshal(v interface{}) ([]byte, error)
+		Unmarshal(data []byte, v interface{}) error
+	}
+
+	// Compressor compresses and decompresses message bodies for a content encoding.
+	Compressor interface {
+		Compress(data []byte) ([]byte, error)
+		Decompress(data []byte) ([]byte, error)
+	}
+
+	// JSONCodec is the json Codec.
+	JSONCodec struct{}
+
+	// MsgPackCodec is the MessagePack Codec.
+	MsgPackCodec struct{}
+
+	// ProtobufCodec is the Protocol Buffers Codec. It can only marshal protobuf payloads,
+	// so it must be used with the CloudEvents binary format. Unmarshaling into an empty
+	// interface keeps the raw bytes, to be unmarshaled later into the payload type.
+	ProtobufCodec struct{}
+
+	// GzipCompressor is the gzip Compressor.
+	GzipCompressor struct{}
+)
+
+var (
+	codecsMu = &sync.RWMutex{}
+	codecs   = map[string]Codec{
+		ContentTypeJSON:          JSONCodec{},
+		"text/json":              JSONCodec{},
+		ContentTypeMsgPack:       MsgPackCodec{},
+		"application/x-msgpack":  MsgPackCodec{},
+		ContentTypeProtobuf:      ProtobufCodec{},
+		"application/x-protobuf": ProtobufCodec{},
+	}
+	compressors = map[string]Compressor{
+		ContentEncodingGzip: GzipCompressor{},
+	}
+)
+
+// RegisterCodec registers the codec for the content type, replacing any registered one.
+func RegisterCodec(contentType string, codec Codec) {
+	codecsMu.Lock()
+	codecs[mediaType(contentType)] = codec
+	codecsMu.Unlock()
+}
+
+// RegisterCompressor registers the compressor for the content encoding, replacing any registered one.
+func RegisterCompressor(contentEncoding string, compressor Compressor) {
+	codecsMu.Lock()
+	compressors[strings.ToLower(contentEncoding)] = compressor
+	codecsMu.Unlock()
+}
+
+// CodecFor returns the codec for the content type. Empty, unregistered and "+json" content
+// types use the json codec, as sgul events have always been json encoded.
+func CodecFor(contentType string) Codec {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	if codec, ok := codecs[mediaType(contentType)]; ok {
+		return codec
+	}
+	return JSONCodec{}
+}
+
+// compressorFor returns the compressor for the content encoding (nil for no encoding).
+func compressorFor(contentEncoding string) (Compressor, error) {
+	if contentEncoding == "" || strings.ToLower(contentEncoding) == "identity" {
+		return nil, nil
+	}
+
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	if compressor, ok := compressors[strings.ToLower(contentEncoding)]; ok {
+		return compressor, nil
+	}
+	return nil, fmt.Errorf("unsupported content encoding '%s'", contentEncoding)
+}
+
+// compress compresses the data for the content encoding.
+func compress(contentEncoding string, data []byte) ([]byte, error) {
+	compressor, err := compressorFor(contentEncoding)
+	if err != nil || compressor == nil {
+		return data, err
+	}
+	return compressor.Compress(data)
+}
+
+// decompress decompresses the data for the content encoding.
+func decompress(contentEncoding string, data []byte) ([]byte, error) {
+	compressor, err := compressorFor(contentEncoding)
+	if err != nil || compressor == nil {
+		return data, err
+	}
+	return compressor.Decompress(data)
+}
+
+// mediaType returns the content type without parameters (a.e. "; charset=utf-8").
+func mediaType(contentType string) string {
+	return strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+}
+
+// isJSON checks if the content type is a json one.
+func isJSON(contentType string) bool {
+	mt := mediaType(contentType)
+	if mt == "" || strings.HasSuffix(mt, "+json") {
+		return true
+	}
+	_, ok := CodecFor(mt).(JSONCodec)
+	return ok
+}
+
+// Marshal marshals v to json.
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal unmarshals json data into v.
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// Marshal marshals v to MessagePack, using json field names.
+func (MsgPackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := msgpack.NewEncoder(&buf).UseJSONTag(true).Encode(v)
+	return buf.Bytes(), err
+}
+
+// Unmarshal unmarshals MessagePack data into v, using json field names.
+func (MsgPackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.NewDecoder(bytes.NewReader(data)).UseJSONTag(true).Decode(v)
+}
+
+// Marshal marshals a protobuf message.
+func (ProtobufCodec) Marshal(v interface{}) ([]byte, error) {
+	if data, ok := v.([]byte); ok {
+		return data, nil
+	}
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, ErrNotProtoMessage
+	}
+	return proto.Marshal(m)
+}
+
+// Unmarshal unmarshals data into a protobuf message, or keeps the raw data into an empty interface.
+func (ProtobufCodec) Unmarshal(data []byte, v interface{}) error {
+	switch target := v.(type) {
+	case proto.Message:
+		return proto.Unmarshal(data, target)
+	case *interface{}:
+		*target = append([]byte(nil), data...)
+		return nil
+	default:
+		return ErrNotProtoMessage
+	}
+}
+
+// Compress gzips data.
+func (GzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress gunzips data.
+func (GzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
@@ -104,6 +104,12 @@ type (
 		// For a SuglREG registry it is in the form of http://<host>:<port>.
 		// This URL must be without trailing slash.
 		URL string
+		// URLs are the urls of federated service registries (a.e. one for each datacenter),
+		// used after URL, if set. They must be without trailing slash.
+		URLs []string
+		// Mode is the federated service registries query mode: "failover" (default)
+		// uses the first reachable registry, "merge" merges all the registries responses.
+		Mode string
 		// Fallback is the fallback service registry used in case of the service registry
 		// does not respond at the client startup or respond with and empty list, so we have an
 		// empty local registry.
@@ -114,6 +120,52 @@ type (
 		// WatchInterval specifies the duration of a single interval between
 		// two service discovery invocations from a service registry watcher.
 		WatchInterval time.Duration
+		// Backoff defines the exponential backoff policy used between two
+		// service registration retries. Jitter is a randomization factor in [0, 1],
+		// NoJitter disables it (a zero Jitter means the default one).
+		Backoff struct {
+			InitialInterval time.Duration
+			MaxInterval     time.Duration
+			Multiplier      float64
+			Jitter          float64
+			NoJitter        bool
+		}
+		// Registration defines how a service instance registers itself
+		// with the service registry.
+		Registration struct {
+			// Auto enables the service self-registration at startup.
+			Auto bool
+			// Host overrides the detected host (or IP) advertised to the registry.
+			Host string
+			// Schema is the advertised schema. Default is "http".
+			Schema string
+			// InfoPath is the advertised management info path. Default is "/info".
+			InfoPath string
+			// DeregisterOnSignal makes the agent deregister the instance on SIGTERM or SIGINT
+			// and raise the signal again. It is opt-in (disabled by default): when disabled
+			// the instance is not deregistered on signals and the application must call
+			// REGAgent.Deregister on its own shutdown path.
+			DeregisterOnSignal bool
+		}
+		// Security defines the credentials used to authenticate calls to the service registry.
+		Security struct {
+			// Auth is the authentication type: "bearer", "jwt", "hmac" or empty for none.
+			Auth string
+			// Token is the static token for the "bearer" authentication.
+			Token string
+			// Secret is the shared secret for "jwt" and "hmac" authentication.
+			// For "jwt" authentication the API JWT secret is used if empty.
+			Secret string
+			// KeyID identifies the shared secret for the "hmac" authentication.
+			KeyID string
+			// TLS defines client certificate and CA for mutual TLS authentication.
+			TLS struct {
+				CertFile           string
+				KeyFile            string
+				CAFile             string
+				InsecureSkipVerify bool
+			}
+		}
 	}
 
 	// BalancingStrategy defines the load balancing strategy.
@@ -164,6 +216,38 @@ type (
 		Balancing BalancingStrategy
 	}
 
+	// Events configuration
+	Events struct {
+		// Transport is the events transport: "amqp" (default), "memory", "nats" or "redis".
+		// Publishers and subscribers topology is defined in the AMQP configuration.
+		Transport string
+		// NATS is the NATS server url and the client connection name.
+		NATS struct {
+			URL  string
+			Name string
+		}
+		// Redis defines the Redis Streams server and the streams: events are published
+		// on streams prefixed with Prefix, trimmed to about MaxLen entries (0 means no limit).
+		// Subscribers wait up to Block for new events on each read.
+		Redis struct {
+			Addr     string
+			Password string
+			DB       int
+			Prefix   string
+			MaxLen   int64
+			Block    time.Duration
+			// Reconnect defines the exponential backoff policy used when reading from Redis fails.
+			// NoJitter disables the jitter (a zero Jitter means the default one).
+			Reconnect struct {
+				InitialInterval time.Duration
+				MaxInterval     time.Duration
+				Multiplier      float64
+				Jitter          float64
+				NoJitter        bool
+			}
+		}
+	}
+
 	// Ldap configuration
 	Ldap struct {
 		Base   string
@@ -181,15 +265,58 @@ type (
 
 	// AMQP configuration
 	AMQP struct {
-		User        string
-		Password    string
-		Host        string
-		Port        int
-		VHost       string
+		User     string
+		Password string
+		Host     string
+		Port     int
+		VHost    string
+		// ConnectionName is the connection name shown by the broker management tools.
+		ConnectionName string
+		// Heartbeat is the connection heartbeat interval (less than 1s uses the server one).
+		Heartbeat time.Duration
+		// TLS enables amqps connections, with optional client certificate and CA.
+		// ServerName overrides the server name verified against the broker certificate (default Host).
+		TLS struct {
+			Enabled            bool
+			CertFile           string
+			KeyFile            string
+			CAFile             string
+			ServerName         string
+			InsecureSkipVerify bool
+		}
 		Exchanges   []Exchange
 		Queues      []Queue
+		Bindings    []Binding
 		Publishers  []Publisher
 		Subscribers []Subscriber
+		// ChannelPoolSize is the maximum number of channels used for concurrent publishing.
+		ChannelPoolSize int
+		// DryRun makes Connect only report the differences between the configured
+		// topology and the broker one, without declaring anything.
+		DryRun bool
+		// Outbox defines the transactional outbox relay: events are relayed each Interval,
+		// at most BatchSize at a time, waiting for each broker confirmation up to ConfirmTimeout.
+		// Events failing MaxAttempts times (broker outages excluded) are parked as failed.
+		// The relay holding the outbox lease (renewed before each event, lasting LeaseTTL)
+		// is the only one relaying events.
+		Outbox struct {
+			Interval       time.Duration
+			BatchSize      int
+			ConfirmTimeout time.Duration
+			MaxAttempts    int
+			LeaseTTL       time.Duration
+		}
+		// Reconnect defines the exponential backoff policy used to recover a lost connection.
+		// MaxAttempts is the maximum number of reconnection attempts (0 means forever).
+		// NoJitter disables the jitter (a zero Jitter means the default one).
+		Reconnect struct {
+			InitialInterval time.Duration
+			MaxInterval     time.Duration
+			Multiplier      float64
+			Jitter          float64
+			NoJitter        bool
+			MaxAttempts     int
+		}
 	}
 
 	// Exchange is the config struct for an AMQP Exchange.
@@ -200,6 +327,8 @@ type (
 		Durable    bool
 		Internal   bool
 		NoWait     bool
+		// Args are the exchange declaration arguments (a.e. "alternate-exchange").
+		Args map[string]interface{}
 	}
 
 	// Queue is the config struct for an AMQP Queue.
@@ -210,16 +339,61 @@ type (
 		Internal   bool
 		Exclusive  bool
 		NoWait     bool
+		// DeadLetterExchange and DeadLetterRoutingKey define where rejected
+		// and expired messages are dead-lettered (x-dead-letter-* arguments).
+		DeadLetterExchange   string
+		DeadLetterRoutingKey string
+		// MessageTTL is the queue messages time-to-live (x-message-ttl argument).
+		MessageTTL time.Duration
+		// Args are the queue declaration arguments (a.e. "x-queue-type", "x-max-length",
+		// "x-max-priority", "x-queue-mode"). Well-known arguments are validated.
+		Args map[string]interface{}
+	}
+
+	// Binding is the config struct for an AMQP binding.
+	// It binds the Queue (or the Destination exchange for exchange-to-exchange bindings)
+	// to the Exchange, once for each routing key (with empty routing key if none).
+	// Args are the binding arguments, a.e. the headers to match for a "headers" exchange.
+	Binding struct {
+		Queue       string
+		Destination string
+		Exchange    string
+		RoutingKeys []string
+		Args        map[string]interface{}
+		NoWait      bool
 	}
 
 	// Publisher is the config struct for an AMQP Publisher.
 	Publisher struct {
-		Name        string
-		Exchange    string
-		RoutingKey  string
-		ContentType string
+		Name       string
+		Exchange   string
+		RoutingKey string
+		// ContentType selects the events codec (json, msgpack, protobuf), ContentEncoding
+		// the message body compression (a.e. "gzip").
+		ContentType     string
+		ContentEncoding string
 		// 2: "persistent" or 1: "non-persistent"
 		DeliveryMode uint8
+		// Mandatory makes the broker return unroutable messages.
+		Mandatory bool
+		// Immediate makes the broker return messages that cannot be
+		// immediately consumed (not supported by RabbitMQ).
+		Immediate bool
+		// Confirm makes the publisher wait for the broker confirmation
+		// of each message, up to ConfirmTimeout (if any).
+		Confirm        bool
+		ConfirmTimeout time.Duration
+		// Format is the events wire format: "sgul" (default) or CloudEvents
+		// "structured" or "binary" mode.
+		Format string
+		// Buffer defines the local buffer keeping up to Size events while the broker
+		// is unreachable: "memory" or "disk" Type (no buffer if empty). Disk buffers
+		// are kept in a Dir sub-directory named after the publisher.
+		Buffer struct {
+			Type string
+			Size int
+			Dir  string
+		}
 	}
 
 	// Subscriber is the config struct for an AMQP Subscriber.
@@ -230,6 +404,32 @@ type (
 		NoLocal   bool
 		NoWait    bool
 		Exclusive bool
+		// Prefetch is the number of unacked messages the broker delivers
+		// to the subscriber (0 means no limit).
+		Prefetch int
+		// Workers is the number of goroutines handling events concurrently.
+		Workers int
+		// DrainTimeout is the maximum wait time for in-flight events on shutdown:
+		// then they are requeued.
+		DrainTimeout time.Duration
+		// Retry defines how failed messages are retried. Each failed message is
+		// delayed in a TTL retry queue (one for each delay, the last one is used for
+		// further attempts) and then sent back to the subscriber queue, up to MaxAttempts times.
+		// Then it is dead-lettered to DeadLetterExchange, with the failure reason in headers,
+		// or rejected if no dead letter exchange is set.
+		Retry struct {
+			MaxAttempts          int
+			Delays               []time.Duration
+			DeadLetterExchange   string
+			DeadLetterRoutingKey string
+		}
+		// Dedup enables the in-memory deduplication of events by ID,
+		// remembering at most Size processed events for TTL.
+		Dedup struct {
+			Enabled bool
+			Size    int
+			TTL     time.Duration
+		}
 	}
 
 	// Configuration describe the type for the configuration file
@@ -242,6 +442,7 @@ type (
 		Log        Log
 		Ldap       Ldap
 		AMQP       AMQP
+		Events     Events
 	}
 )
 
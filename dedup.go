@@ -0,0 +1,196 @@
+// Copyright 2019 Luca Stasio <joshuagame@gmail.com>
+// Copyright 2019 IT Resources s.r.l.
+//
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package sgul defines common structures and functionalities for applications.
+// dedup.go defines the deduplication stores used by subscribers to process each event only once.
+package sgul
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Deduplication store defaults.
+const (
+	DefaultDedupSize = 10000
+	DefaultDedupTTL  = 24 * time.Hour
+)
+
+// ErrDuplicateEvent is returned by a DedupStore for an already processed event.
+var ErrDuplicateEvent = errors.New("duplicate event")
+
+type ctxTKey int
+
+const ctxTransactionKey ctxTKey = iota
+
+// DedupStore keeps track of the events processed by each consumer.
+type DedupStore interface {
+	// Process calls fn unless the event with ID "id" has already been processed by
+	// the consumer, in which case it returns ErrDuplicateEvent. The event is recorded
+	// as processed only if fn succeeds.
+	Process(ctx context.Context, consumer string, id string, fn func(ctx context.Context) error) error
+}
+
+type (
+	// MemoryDedupStore is an in-memory LRU DedupStore. Processed events are
+	// forgotten after TTL or when the store exceeds its size.
+	// It does not survive restarts and is not shared between service instances.
+	MemoryDedupStore struct {
+		size    int
+		ttl     time.Duration
+		mu      *sync.Mutex
+		entries map[string]*list.Element
+		lru     *list.List
+		// inflight keeps the events being processed, so that concurrent
+		// duplicates are not processed twice.
+		inflight map[string]struct{}
+	}
+
+	memoryDedupEntry struct {
+		key         string
+		processedAt time.Time
+	}
+)
+
+// NewMemoryDedupStore returns a new in-memory DedupStore keeping at most size
+// processed events for ttl. Default size and ttl are used for zero values.
+func NewMemoryDedupStore(size int, ttl time.Duration) *MemoryDedupStore {
+	if size <= 0 {
+		size = DefaultDedupSize
+	}
+	if ttl <= 0 {
+		ttl = DefaultDedupTTL
+	}
+	return &MemoryDedupStore{
+		size:     size,
+		ttl:      ttl,
+		mu:       &sync.Mutex{},
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		inflight: make(map[string]struct{}),
+	}
+}
+
+// Process calls fn unless the event has already been processed (or is being processed) by the consumer.
+func (s *MemoryDedupStore) Process(ctx context.Context, consumer string, id string, fn func(ctx context.Context) error) error {
+	key := consumer + "/" + id
+
+	s.mu.Lock()
+	if s.seen(key) {
+		s.mu.Unlock()
+		return ErrDuplicateEvent
+	}
+	if _, ok := s.inflight[key]; ok {
+		s.mu.Unlock()
+		return ErrDuplicateEvent
+	}
+	s.inflight[key] = struct{}{}
+	s.mu.Unlock()
+
+	err := fn(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.inflight, key)
+	if err == nil {
+		s.add(key)
+	}
+	return err
+}
+
+// seen checks if key has been processed within ttl. Must be called holding mu.
+func (s *MemoryDedupStore) seen(key string) bool {
+	e, ok := s.entries[key]
+	if !ok {
+		return false
+	}
+	if time.Since(e.Value.(*memoryDedupEntry).processedAt) > s.ttl {
+		s.lru.Remove(e)
+		delete(s.entries, key)
+		return false
+	}
+	s.lru.MoveToFront(e)
+	return true
+}
+
+// add records key as processed, evicting the least recently used keys. Must be called holding mu.
+func (s *MemoryDedupStore) add(key string) {
+	s.entries[key] = s.lru.PushFront(&memoryDedupEntry{key: key, processedAt: time.Now()})
+	for s.lru.Len() > s.size {
+		e := s.lru.Back()
+		s.lru.Remove(e)
+		delete(s.entries, e.Value.(*memoryDedupEntry).key)
+	}
+}
+
+type (
+	// GormDedupStore is a DedupStore recording processed events into a database table.
+	// The event is recorded in the same transaction fn runs in: handlers can get
+	// it with GetTransaction(ctx) to make their own changes atomically with the
+	// event processing.
+	GormDedupStore struct {
+		db *gorm.DB
+	}
+
+	// ProcessedEvent is an event recorded as processed by a consumer.
+	ProcessedEvent struct {
+		Consumer    string `gorm:"primary_key;size:255"`
+		EventID     string `gorm:"primary_key;size:255"`
+		ProcessedAt time.Time
+	}
+)
+
+// TableName returns the processed events table name.
+func (ProcessedEvent) TableName() string {
+	return "sgul_processed_events"
+}
+
+// NewGormDedupStore returns a new database DedupStore.
+func NewGormDedupStore(db *gorm.DB) *GormDedupStore {
+	return &GormDedupStore{db: db}
+}
+
+// Migrate creates (or updates) the processed events table.
+func (s *GormDedupStore) Migrate() error {
+	return s.db.AutoMigrate(&ProcessedEvent{}).Error
+}
+
+// Process calls fn in a transaction, unless the event has already been processed by
+// the consumer. The processed event is recorded in the same transaction, which is
+// committed only if fn succeeds: concurrent duplicates fail on the table primary key.
+func (s *GormDedupStore) Process(ctx context.Context, consumer string, id string, fn func(ctx context.Context) error) error {
+	return NewRepository(s.db).DoInTransaction(func(tx *gorm.DB) error {
+		var count int
+		if err := tx.Model(&ProcessedEvent{}).Where("consumer = ? AND event_id = ?", consumer, id).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrDuplicateEvent
+		}
+
+		if err := fn(context.WithValue(ctx, ctxTransactionKey, tx)); err != nil {
+			return err
+		}
+
+		return tx.Create(&ProcessedEvent{Consumer: consumer, EventID: id, ProcessedAt: time.Now()}).Error
+	})
+}
+
+// Purge deletes the events processed before olderThan.
+func (s *GormDedupStore) Purge(olderThan time.Duration) error {
+	return s.db.Where("processed_at < ?", time.Now().Add(-olderThan)).Delete(&ProcessedEvent{}).Error
+}
+
+// GetTransaction returns the gorm transaction the event is processed in, if any.
+func GetTransaction(ctx context.Context) (*gorm.DB, bool) {
+	tx, ok := ctx.Value(ctxTransactionKey).(*gorm.DB)
+	return tx, ok
+}
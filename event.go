@@ -9,8 +9,14 @@
 // into an amqp event bus.
 package sgul
 
+import "time"
+
 // Event is the struct used to push event messages into AMQP queues.
 type Event struct {
+	// ID is the event unique identifier, used by consumers to detect duplicates.
+	// It is generated on publishing if empty.
+	ID string
+
 	// Name is the global identifier for event. It MUST be
 	// composed as "<action>_<resource>", a.e. "new_user", "upd_user", "del_user", ...
 	Name string
@@ -23,13 +29,60 @@ type Event struct {
 	// The AMQP Publisher will marshal it to json and the AMQP Subscriber
 	// will unmarshal it into a specific request (something like a dto).
 	Payload interface{}
+
+	// Version is the event schema version: older versions are upcasted
+	// to the current one before being handled (0 means unversioned).
+	Version int `json:",omitempty"`
+
+	// Type is the CloudEvents event type (a.e. "com.example.user.created").
+	// Name is used if empty.
+	Type string `json:",omitempty"`
+
+	// Time is the event occurrence time.
+	Time time.Time
+
+	// SpecVersion is the CloudEvents specification version.
+	SpecVersion string `json:",omitempty"`
+
+	// Subject is the subject of the event in the context of the Source (a.e. the resource id).
+	Subject string `json:",omitempty"`
+
+	// DataContentType is the Payload content type ("application/json" if empty).
+	DataContentType string `json:",omitempty"`
+
+	// CorrelationID identifies the whole flow of events the event belongs to.
+	CorrelationID string `json:",omitempty"`
+
+	// CausationID is the ID of the event which caused this event.
+	CausationID string `json:",omitempty"`
+
+	// Tenant is the tenant the event belongs to.
+	Tenant string `json:",omitempty"`
 }
 
-// NewEvent return a new Event instance.
+// NewEvent return a new Event instance, with the current version of the "name"-event.
 func NewEvent(name string, source string, payload interface{}) Event {
 	return Event{
-		Name:    name,
-		Source:  source,
-		Payload: payload,
+		ID:          newUUID(),
+		Version:     CurrentVersion(name),
+		Name:        name,
+		Source:      source,
+		Payload:     payload,
+		Time:        time.Now(),
+		SpecVersion: CloudEventsSpecVersion,
+	}
+}
+
+// CausedBy returns the event as caused by the "cause"-event: the causation ID is
+// the cause ID and the correlation ID is inherited from the cause (or is the cause ID).
+func (e Event) CausedBy(cause Event) Event {
+	e.CausationID = cause.ID
+	e.CorrelationID = cause.CorrelationID
+	if e.CorrelationID == "" {
+		e.CorrelationID = cause.ID
+	}
+	if e.Tenant == "" {
+		e.Tenant = cause.Tenant
 	}
+	return e
 }
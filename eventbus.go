@@ -0,0 +1,458 @@
+// Copyright 2019 Luca Stasio <joshuagame@gmail.com>
+// Copyright 2019 IT Resources s.r.l.
+//
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package sgul defines common structures and functionalities for applications.
+// eventbus.go defines the in-process EventBus, routing events like an AMQP broker.
+package sgul
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrEventBusClosed is returned when publishing on a closed EventBus.
+var ErrEventBusClosed = errors.New("event bus closed")
+
+type (
+	// EventBus is an in-process events transport. It routes events through the exchanges,
+	// queues and bindings of the AMQP configuration with the AMQP semantics (direct,
+	// fanout and topic exchanges, default exchange, exchange-to-exchange bindings),
+	// so that code can switch between the in-process and the AMQP transports through configuration.
+	// Events are not persisted. They are encoded on publish and decoded for each handler,
+	// as with the broker transports: handlers get their own copy of the generic payload.
+	EventBus struct {
+		mu          *sync.RWMutex
+		exchanges   map[string]string
+		bindings    map[string][]busBinding
+		queues      map[string]*busQueue
+		Publishers  map[string]*BusPublisher
+		Subscribers map[string]*BusSubscriber
+		closed      bool
+	}
+
+	// BusPublisher publishes events on the EventBus.
+	BusPublisher struct {
+		Bus             *EventBus
+		Name            string
+		Exchange        string
+		RoutingKey      string
+		ContentType     string
+		ContentEncoding string
+		Format          string
+	}
+
+	// BusSubscriber consumes events from an EventBus queue.
+	// Failed events are retried up to MaxAttempts times, then they are dead-lettered
+	// to DeadLetterExchange (if any) or dropped. With no MaxAttempts, failed events
+	// are requeued, as AMQP subscribers do.
+	BusSubscriber struct {
+		Bus                  *EventBus
+		Name                 string
+		Queue                string
+		MaxAttempts          int
+		RetryDelays          []time.Duration
+		DeadLetterExchange   string
+		DeadLetterRoutingKey string
+		Dedup                DedupStore
+
+		handler EventHandler
+		mu      *sync.Mutex
+		stop    chan struct{}
+		done    chan struct{}
+	}
+
+	busBinding struct {
+		queue       string
+		destination string
+		key         string
+	}
+
+	busMessage struct {
+		headers  map[string]string
+		body     []byte
+		key      string
+		attempts int
+	}
+
+	// busQueue is an unbounded FIFO queue of messages.
+	busQueue struct {
+		mu       *sync.Mutex
+		messages []busMessage
+		ready    chan struct{}
+	}
+)
+
+// NewEventBus returns a new EventBus with the exchanges, queues, bindings, publishers
+// and subscribers of the AMQP configuration. Headers exchanges are not supported.
+func NewEventBus() (*EventBus, error) {
+	return newEventBus(GetConfiguration().AMQP)
+}
+
+// newEventBus returns a new in-process event bus for the AMQP configuration.
+func newEventBus(amqpConf AMQP) (*EventBus, error) {
+	bus := &EventBus{
+		mu:          &sync.RWMutex{},
+		exchanges:   make(map[string]string),
+		bindings:    make(map[string][]busBinding),
+		queues:      make(map[string]*busQueue),
+		Publishers:  make(map[string]*BusPublisher),
+		Subscribers: make(map[string]*BusSubscriber),
+	}
+
+	for _, exchange := range amqpConf.Exchanges {
+		extype := strings.ToLower(exchange.Type)
+		if extype != "direct" && extype != "fanout" && extype != "topic" {
+			return nil, fmt.Errorf("exchange '%s': type '%s' not supported by the event bus", exchange.Name, exchange.Type)
+		}
+		bus.exchanges[exchange.Name] = extype
+	}
+
+	for _, queue := range amqpConf.Queues {
+		bus.queues[queue.Name] = newBusQueue()
+	}
+
+	for _, binding := range amqpConf.Bindings {
+		routingKeys := binding.RoutingKeys
+		if len(routingKeys) == 0 {
+			routingKeys = []string{""}
+		}
+		for _, key := range routingKeys {
+			bus.bindings[binding.Exchange] = append(bus.bindings[binding.Exchange], busBinding{
+				queue:       binding.Queue,
+				destination: binding.Destination,
+				key:         key,
+			})
+		}
+	}
+
+	for _, p := range amqpConf.Publishers {
+		bus.Publishers[p.Name] = &BusPublisher{
+			Bus:             bus,
+			Name:            p.Name,
+			Exchange:        p.Exchange,
+			RoutingKey:      p.RoutingKey,
+			ContentType:     p.ContentType,
+			ContentEncoding: p.ContentEncoding,
+			Format:          p.Format,
+		}
+	}
+
+	for _, s := range amqpConf.Subscribers {
+		if _, ok := bus.queues[s.Queue]; !ok {
+			return nil, fmt.Errorf("subscriber '%s': unknown queue '%s'", s.Name, s.Queue)
+		}
+
+		var dedup DedupStore
+		if s.Dedup.Enabled {
+			dedup = NewMemoryDedupStore(s.Dedup.Size, s.Dedup.TTL)
+		}
+		bus.Subscribers[s.Name] = &BusSubscriber{
+			Bus:                  bus,
+			Name:                 s.Name,
+			Queue:                s.Queue,
+			MaxAttempts:          s.Retry.MaxAttempts,
+			RetryDelays:          s.Retry.Delays,
+			DeadLetterExchange:   s.Retry.DeadLetterExchange,
+			DeadLetterRoutingKey: s.Retry.DeadLetterRoutingKey,
+			Dedup:                dedup,
+			mu:                   &sync.Mutex{},
+		}
+	}
+
+	return bus, nil
+}
+
+// Connect is a no-op: the EventBus is ready as soon as it is created.
+func (bus *EventBus) Connect() error {
+	return nil
+}
+
+// Close stops all the subscribers. Events are no longer accepted.
+func (bus *EventBus) Close() error {
+	bus.mu.Lock()
+	bus.closed = true
+	bus.mu.Unlock()
+
+	for _, sub := range bus.Subscribers {
+		sub.Stop()
+	}
+	return nil
+}
+
+// EventPublisher returns the "name"-publisher as an EventPublisher.
+func (bus *EventBus) EventPublisher(name string) (EventPublisher, error) {
+	if pub, ok := bus.Publishers[name]; ok {
+		return pub, nil
+	}
+	return nil, fmt.Errorf("no configuration found for publisher '%s'", name)
+}
+
+// EventSubscriber returns the "name"-subscriber as an EventSubscriber.
+func (bus *EventBus) EventSubscriber(name string) (EventSubscriber, error) {
+	if sub, ok := bus.Subscribers[name]; ok {
+		return sub, nil
+	}
+	return nil, fmt.Errorf("no configuration found for subscriber '%s'", name)
+}
+
+// Handle registers the event handler for the "name"-subscriber.
+func (bus *EventBus) Handle(name string, handler EventHandler) {
+	if sub, ok := bus.Subscribers[name]; ok {
+		sub.Handle(handler)
+	}
+}
+
+// publish routes the message from the exchange to the bound queues.
+func (bus *EventBus) publish(exchange string, key string, m busMessage) error {
+	bus.mu.RLock()
+	defer bus.mu.RUnlock()
+	if bus.closed {
+		return ErrEventBusClosed
+	}
+
+	m.key = key
+	for _, queue := range bus.route(exchange, key, map[string]bool{}) {
+		bus.queues[queue].push(m)
+	}
+	return nil
+}
+
+// route returns the queues the routing key is routed to from the exchange.
+// Must be called holding mu.
+func (bus *EventBus) route(exchange string, key string, visited map[string]bool) []string {
+	if exchange == "" {
+		// default exchange: routes to the queue named as the routing key
+		if _, ok := bus.queues[key]; ok {
+			return []string{key}
+		}
+		return nil
+	}
+	if visited[exchange] {
+		return nil
+	}
+	visited[exchange] = true
+
+	queues := []string{}
+	extype := bus.exchanges[exchange]
+	for _, binding := range bus.bindings[exchange] {
+		if !routingKeyMatches(extype, binding.key, key) {
+			continue
+		}
+		if binding.queue != "" {
+			if _, ok := bus.queues[binding.queue]; ok {
+				queues = append(queues, binding.queue)
+			}
+			continue
+		}
+		queues = append(queues, bus.route(binding.destination, key, visited)...)
+	}
+	return MergeStringSlices(queues, nil)
+}
+
+// routingKeyMatches checks if the routing key matches the binding key for the exchange type.
+func routingKeyMatches(extype string, bindingKey string, key string) bool {
+	switch extype {
+	case "fanout":
+		return true
+	case "topic":
+		return topicMatches(strings.Split(bindingKey, "."), strings.Split(key, "."))
+	default:
+		return bindingKey == key
+	}
+}
+
+// topicMatches matches the routing key words against the topic binding pattern words:
+// "*" matches exactly one word, "#" matches zero or more words.
+func topicMatches(pattern []string, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if topicMatches(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && topicMatches(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && topicMatches(pattern[1:], words[1:])
+	}
+}
+
+// Publish publishes the event to the publisher exchange with the publisher routing key.
+func (pub *BusPublisher) Publish(event Event) error {
+	headers, body, err := encodeMessage(event, pub.Format, pub.ContentType, pub.ContentEncoding)
+	if err != nil {
+		return err
+	}
+	return pub.Bus.publish(pub.Exchange, pub.RoutingKey, busMessage{headers: headers, body: body})
+}
+
+// Handle sets the subscriber event handler.
+func (sub *BusSubscriber) Handle(handler EventHandler) {
+	sub.mu.Lock()
+	sub.handler = handler
+	sub.mu.Unlock()
+}
+
+// Start starts consuming events from the subscriber queue in a goroutine.
+func (sub *BusSubscriber) Start() error {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	if sub.stop != nil {
+		return nil
+	}
+	if sub.handler == nil {
+		return ErrNoEventHandler
+	}
+
+	sub.stop = make(chan struct{})
+	sub.done = make(chan struct{})
+	go sub.run(sub.Bus.queues[sub.Queue], sub.handler, sub.stop, sub.done)
+
+	return nil
+}
+
+// Stop stops consuming events and waits for the event being handled, if any.
+// Events not yet consumed are kept in the queue.
+func (sub *BusSubscriber) Stop() error {
+	sub.mu.Lock()
+	stop, done := sub.stop, sub.done
+	sub.stop, sub.done = nil, nil
+	sub.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	return nil
+}
+
+func (sub *BusSubscriber) run(queue *busQueue, handler EventHandler, stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	for {
+		m, ok := queue.pop(stop)
+		if !ok {
+			return
+		}
+		sub.handle(handler, m)
+	}
+}
+
+// handle decodes and upcasts the event and calls the event handler (through the deduplication
+// store, if any). Failed events are requeued, retried with delay or dead-lettered.
+func (sub *BusSubscriber) handle(handler EventHandler, m busMessage) {
+	event, err := decodeMessage(m.headers, m.body)
+	if err == nil {
+		err = dispatchEvent(context.Background(), sub.Name, sub.Dedup, handler, event)
+		if err == nil || err == ErrDuplicateEvent {
+			return
+		}
+	}
+	log.Printf("subscriber %s: error handling event %s: %s", sub.Name, event.Name, err)
+
+	// the message can be routed to many queues: headers are not shared
+	headers := make(map[string]string, len(m.headers)+2)
+	for k, v := range m.headers {
+		headers[k] = v
+	}
+	headers[HeaderFailureReason] = err.Error()
+	m.headers = headers
+
+	if unprocessable(err) || event.Name == "" {
+		sub.deadLetter(m)
+		return
+	}
+	if sub.MaxAttempts <= 0 {
+		sub.Bus.publish("", sub.Queue, m)
+		return
+	}
+	if m.attempts >= sub.MaxAttempts {
+		sub.deadLetter(m)
+		return
+	}
+
+	delay := retryDelay(sub.RetryDelays, m.attempts)
+	m.attempts++
+	m.headers[HeaderRetryCount] = strconv.Itoa(m.attempts)
+	time.AfterFunc(delay, func() {
+		sub.Bus.publish("", sub.Queue, m)
+	})
+}
+
+// deadLetter publishes the failed message to the subscriber dead letter exchange, if any.
+func (sub *BusSubscriber) deadLetter(m busMessage) {
+	if sub.DeadLetterExchange == "" {
+		log.Printf("subscriber %s: dropping message %s", sub.Name, m.headers[headerMessageID])
+		return
+	}
+
+	routingKey := sub.DeadLetterRoutingKey
+	if routingKey == "" {
+		routingKey = m.key
+	}
+	m.headers[HeaderFailedQueue] = sub.Queue
+	if err := sub.Bus.publish(sub.DeadLetterExchange, routingKey, busMessage{headers: m.headers, body: m.body}); err != nil {
+		log.Printf("subscriber %s: unable to dead-letter message %s: %s", sub.Name, m.headers[headerMessageID], err)
+	}
+}
+
+func newBusQueue() *busQueue {
+	return &busQueue{
+		mu:    &sync.Mutex{},
+		ready: make(chan struct{}, 1),
+	}
+}
+
+// push appends a message to the queue.
+func (q *busQueue) push(m busMessage) {
+	q.mu.Lock()
+	q.messages = append(q.messages, m)
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop waits for the first message of the queue, till stop is closed.
+func (q *busQueue) pop(stop chan struct{}) (busMessage, bool) {
+	for {
+		q.mu.Lock()
+		if len(q.messages) > 0 {
+			m := q.messages[0]
+			q.messages = q.messages[1:]
+			more := len(q.messages) > 0
+			q.mu.Unlock()
+			if more {
+				// wake up other consumers of the queue
+				select {
+				case q.ready <- struct{}{}:
+				default:
+				}
+			}
+			return m, true
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-stop:
+			return busMessage{}, false
+		case <-q.ready:
+		}
+	}
+}
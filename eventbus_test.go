@@ -0,0 +1,26 @@
+// Copyright 2019 Luca Stasio <joshuagame@gmail.com>
+// Copyright 2019 IT Resources s.r.l.
+//
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package sgul
+
+import "testing"
+
+func TestEventBus(t *testing.T) {
+	for _, tt := range transportTests {
+		t.Run(tt.name, func(t *testing.T) {
+			bus, err := newEventBus(transportTopology(tt))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := bus.Connect(); err != nil {
+				t.Fatal(err)
+			}
+			defer bus.Close()
+
+			runTransportTest(t, tt, bus)
+		})
+	}
+}
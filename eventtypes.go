@@ -0,0 +1,232 @@
+// Copyright 2019 Luca Stasio <joshuagame@gmail.com>
+// Copyright 2019 IT Resources s.r.l.
+//
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package sgul defines common structures and functionalities for applications.
+// eventtypes.go defines the event types registry and the typed event handlers mux.
+package sgul
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// ErrUnknownEvent is returned for events with no registered handler and no fallback handler.
+var ErrUnknownEvent = errors.New("unknown event")
+
+var (
+	eventTypesMu = &sync.RWMutex{}
+	eventTypes   = map[string]reflect.Type{}
+
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+type (
+	// Validator is implemented by payloads validating themselves after decoding.
+	Validator interface {
+		Validate() error
+	}
+
+	// PayloadError is returned when an event payload cannot be decoded into its
+	// registered type or is not valid. Subscribers dead-letter such events instead of retrying them.
+	PayloadError struct {
+		Event string
+		Err   error
+	}
+
+	// EventMux routes events to typed handlers by event name.
+	// Unknown events are passed to the fallback handler, if any.
+	EventMux struct {
+		mu       *sync.RWMutex
+		handlers map[string]EventHandler
+		fallback EventHandler
+	}
+)
+
+func (e *PayloadError) Error() string {
+	return fmt.Sprintf("invalid payload for event %s: %s", e.Event, e.Err)
+}
+
+// RegisterEventType registers the payload type for the "name"-event.
+// The payload sample can be a struct value or pointer.
+func RegisterEventType(name string, payload interface{}) error {
+	return registerEventType(name, reflect.TypeOf(payload))
+}
+
+func registerEventType(name string, t reflect.Type) error {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	eventTypesMu.Lock()
+	defer eventTypesMu.Unlock()
+	if registered, ok := eventTypes[name]; ok && registered != t {
+		return fmt.Errorf("event %s already registered with payload type %s", name, registered)
+	}
+	eventTypes[name] = t
+	return nil
+}
+
+// TypedPayload decodes the event payload into a new instance of the type registered
+// for the event name and validates it. It returns a pointer to the payload.
+func TypedPayload(event Event) (interface{}, error) {
+	eventTypesMu.RLock()
+	t, ok := eventTypes[event.Name]
+	eventTypesMu.RUnlock()
+	if !ok {
+		return nil, ErrUnknownEvent
+	}
+
+	payload := reflect.New(t).Interface()
+	if err := DecodePayload(event, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// DecodePayload decodes the event payload into v (a pointer) and validates it
+// if it implements Validator. Raw payloads (a.e. protobuf) are decoded with the codec
+// for the event DataContentType, generic ones (a.e. maps decoded from json) through json.
+func DecodePayload(event Event, v interface{}) error {
+	if err := decodePayload(event, v); err != nil {
+		return &PayloadError{Event: event.Name, Err: err}
+	}
+
+	if validator, ok := v.(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			return &PayloadError{Event: event.Name, Err: err}
+		}
+	}
+	return nil
+}
+
+func decodePayload(event Event, v interface{}) error {
+	target := reflect.ValueOf(v)
+	if target.Kind() != reflect.Ptr || target.IsNil() {
+		return errors.New("payload target must be a non nil pointer")
+	}
+
+	switch payload := event.Payload.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return CodecFor(event.DataContentType).Unmarshal(payload, v)
+	default:
+		// already typed payload
+		value := reflect.ValueOf(payload)
+		if value.Type() == target.Type() {
+			target.Elem().Set(value.Elem())
+			return nil
+		}
+		if value.Type() == target.Elem().Type() {
+			target.Elem().Set(value)
+			return nil
+		}
+
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(data, v)
+	}
+}
+
+// NewEventMux returns a new EventMux instance.
+func NewEventMux() *EventMux {
+	return &EventMux{
+		mu:       &sync.RWMutex{},
+		handlers: make(map[string]EventHandler),
+	}
+}
+
+// Handle registers the typed handler for the "name"-event. The handler must be a
+// func(context.Context, T) error, where T is the payload type (a struct or a pointer to struct):
+// it is registered as the event payload type.
+// The handler receives the decoded and validated payload.
+func (m *EventMux) Handle(name string, handler interface{}) error {
+	fn := reflect.ValueOf(handler)
+	ft := fn.Type()
+	if ft.Kind() != reflect.Func || ft.NumIn() != 2 || ft.NumOut() != 1 ||
+		!ft.In(0).Implements(contextType) || ft.Out(0) != errorType {
+		return fmt.Errorf("event handler for %s must be a func(context.Context, T) error", name)
+	}
+
+	payloadType := ft.In(1)
+	if err := registerEventType(name, payloadType); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.handlers[name] = func(ctx context.Context, event Event) error {
+		payload := reflect.New(payloadType)
+		if payloadType.Kind() == reflect.Ptr {
+			payload = reflect.New(payloadType.Elem())
+		}
+		if err := DecodePayload(event, payload.Interface()); err != nil {
+			return err
+		}
+		if payloadType.Kind() != reflect.Ptr {
+			payload = payload.Elem()
+		}
+
+		out := fn.Call([]reflect.Value{reflect.ValueOf(ctx), payload})
+		if err, ok := out[0].Interface().(error); ok {
+			return err
+		}
+		return nil
+	}
+	m.mu.Unlock()
+
+	return nil
+}
+
+// HandleEvent registers an untyped event handler for the "name"-event.
+func (m *EventMux) HandleEvent(name string, handler EventHandler) {
+	m.mu.Lock()
+	m.handlers[name] = handler
+	m.mu.Unlock()
+}
+
+// Fallback sets the handler for events with no registered handler.
+func (m *EventMux) Fallback(handler EventHandler) {
+	m.mu.Lock()
+	m.fallback = handler
+	m.mu.Unlock()
+}
+
+// Handler returns the mux as an EventHandler, to be registered with a subscriber.
+func (m *EventMux) Handler() EventHandler {
+	return m.Dispatch
+}
+
+// Dispatch passes the event to the handler registered for its name, or to the fallback handler.
+// It returns ErrUnknownEvent if no handler is found.
+func (m *EventMux) Dispatch(ctx context.Context, event Event) error {
+	m.mu.RLock()
+	handler, ok := m.handlers[event.Name]
+	if !ok {
+		handler = m.fallback
+	}
+	m.mu.RUnlock()
+
+	if handler == nil {
+		return ErrUnknownEvent
+	}
+	return handler(ctx, event)
+}
+
+// unprocessable checks if the handler error means that the event will never be processed.
+func unprocessable(err error) bool {
+	if err == ErrUnknownEvent {
+		return true
+	}
+	_, ok := err.(*PayloadError)
+	return ok
+}
@@ -1,23 +1,28 @@
 module github.com/itross/sgul
 
-go 1.12
+go 1.16
 
 require (
+	github.com/alicebob/miniredis/v2 v2.30.0
 	github.com/casbin/casbin v1.9.1
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/fatih/structs v1.1.0
 	github.com/go-chi/chi v4.0.2+incompatible
 	github.com/go-mach/gm-config v0.0.0-20190711141405-3918a3917e5e
+	github.com/go-redis/redis v6.15.5+incompatible
+	github.com/golang/protobuf v1.4.2
 	github.com/jinzhu/gorm v1.9.10
 	github.com/mattn/go-colorable v0.1.2
 	github.com/mgutz/ansi v0.0.0-20170206155736-9520e82c474b // indirect
 	github.com/natefinch/lumberjack v2.0.0+incompatible
+	github.com/nats-io/nats-server/v2 v2.2.0
+	github.com/nats-io/nats.go v1.11.0
 	github.com/sirupsen/logrus v1.2.0
 	github.com/snowzach/rotatefilehook v0.0.0-20180327172521-2f64f265f58c
 	github.com/spf13/viper v1.4.0
 	github.com/streadway/amqp v0.0.0-20190827072141-edfb9018d271
+	github.com/vmihailenco/msgpack v4.0.4+incompatible
 	github.com/x-cray/logrus-prefixed-formatter v0.5.2
 	go.uber.org/zap v1.10.0
-	golang.org/x/crypto v0.0.0-20190829043050-9756ffdc2472 // indirect
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0 // indirect
 )
@@ -0,0 +1,416 @@
+// Copyright 2019 Luca Stasio <joshuagame@gmail.com>
+// Copyright 2019 IT Resources s.r.l.
+//
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package sgul defines common structures and functionalities for applications.
+// natstransport.go defines the NATS events transport.
+package sgul
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// DefaultNATSPending is the default number of received messages buffered by a NATS subscriber.
+const DefaultNATSPending = 64
+
+type (
+	// NATSTransport is the NATS events transport. The AMQP configuration topology is mapped
+	// on NATS subjects: publishers publish on the "<exchange>.<routing key>" subject and
+	// subscribers subscribe, in a queue group named after their queue, to the subjects of
+	// their queue bindings (topic "#" wildcards are mapped to ">") and to the queue name.
+	// Subjects covered by another subject of the same subscriber are not subscribed.
+	// NATS delivers at most once: messages received while no subscriber is running are lost.
+	NATSTransport struct {
+		URL         string
+		Name        string
+		Conn        *nats.Conn
+		Publishers  map[string]*NATSPublisher
+		Subscribers map[string]*NATSSubscriber
+	}
+
+	// NATSPublisher publishes events on a NATS subject.
+	NATSPublisher struct {
+		Transport       *NATSTransport
+		Name            string
+		Subject         string
+		ContentType     string
+		ContentEncoding string
+		Format          string
+	}
+
+	// NATSSubscriber consumes events from NATS subjects in a queue group.
+	// Failed events are published again on the queue subject, with delay, up to
+	// MaxAttempts times, then they are dead-lettered to DeadLetterExchange (if any) or dropped.
+	// With no MaxAttempts, failed events are published again on the queue subject
+	// straight away, as AMQP subscribers requeue them.
+	NATSSubscriber struct {
+		Transport            *NATSTransport
+		Name                 string
+		Queue                string
+		Subjects             []string
+		Pending              int
+		MaxAttempts          int
+		RetryDelays          []time.Duration
+		DeadLetterExchange   string
+		DeadLetterRoutingKey string
+		Dedup                DedupStore
+
+		handler       EventHandler
+		mu            *sync.Mutex
+		subscriptions []*nats.Subscription
+		stop          chan struct{}
+		done          chan struct{}
+	}
+)
+
+// NewNATSTransport returns a new NATS transport configured with the Events.NATS configuration
+// and the publishers and subscribers of the AMQP configuration.
+func NewNATSTransport() (*NATSTransport, error) {
+	return newNATSTransport(GetConfiguration().Events, GetConfiguration().AMQP)
+}
+
+// newNATSTransport returns a new NATS transport for the events and AMQP configurations.
+func newNATSTransport(events Events, amqpConf AMQP) (*NATSTransport, error) {
+	conf := events.NATS
+	nt := &NATSTransport{
+		URL:         conf.URL,
+		Name:        conf.Name,
+		Publishers:  make(map[string]*NATSPublisher),
+		Subscribers: make(map[string]*NATSSubscriber),
+	}
+	if nt.URL == "" {
+		nt.URL = nats.DefaultURL
+	}
+
+	for _, p := range amqpConf.Publishers {
+		nt.Publishers[p.Name] = &NATSPublisher{
+			Transport:       nt,
+			Name:            p.Name,
+			Subject:         natsSubject(p.Exchange, p.RoutingKey),
+			ContentType:     p.ContentType,
+			ContentEncoding: p.ContentEncoding,
+			Format:          p.Format,
+		}
+	}
+
+	types := exchangeTypes(amqpConf)
+	for _, s := range amqpConf.Subscribers {
+		subjects := []string{s.Queue}
+		for _, binding := range queueBindings(amqpConf, s.Queue) {
+			routingKeys := binding.RoutingKeys
+			if len(routingKeys) == 0 {
+				routingKeys = []string{""}
+			}
+			for _, key := range routingKeys {
+				subjects = append(subjects, natsBindingSubjects(types[binding.Exchange], binding.Exchange, key)...)
+			}
+		}
+
+		var dedup DedupStore
+		if s.Dedup.Enabled {
+			dedup = NewMemoryDedupStore(s.Dedup.Size, s.Dedup.TTL)
+		}
+		nt.Subscribers[s.Name] = &NATSSubscriber{
+			Transport:            nt,
+			Name:                 s.Name,
+			Queue:                s.Queue,
+			Subjects:             natsUncoveredSubjects(MergeStringSlices(subjects, nil)),
+			Pending:              s.Prefetch,
+			MaxAttempts:          s.Retry.MaxAttempts,
+			RetryDelays:          s.Retry.Delays,
+			DeadLetterExchange:   s.Retry.DeadLetterExchange,
+			DeadLetterRoutingKey: s.Retry.DeadLetterRoutingKey,
+			Dedup:                dedup,
+			mu:                   &sync.Mutex{},
+		}
+	}
+
+	return nt, nil
+}
+
+// natsSubject returns the subject for an exchange and a routing key.
+func natsSubject(exchange string, key string) string {
+	switch {
+	case exchange == "":
+		return key
+	case key == "":
+		return exchange
+	default:
+		return exchange + "." + key
+	}
+}
+
+// natsBindingSubjects returns the subjects matching an exchange binding.
+func natsBindingSubjects(extype string, exchange string, key string) []string {
+	switch extype {
+	case "fanout":
+		return []string{exchange, exchange + ".>"}
+	case "topic":
+		words := strings.Split(key, ".")
+		for i, word := range words {
+			if word == "#" {
+				if i == len(words)-1 {
+					// "a.#" also matches "a"
+					return []string{natsSubject(exchange, strings.Join(words[:i], ".")), natsSubject(exchange, strings.Join(append(words[:i:i], ">"), "."))}
+				}
+				// NATS has no multi-words wildcard in the middle of a subject
+				words[i] = "*"
+			}
+		}
+		return []string{natsSubject(exchange, strings.Join(words, "."))}
+	default:
+		return []string{natsSubject(exchange, key)}
+	}
+}
+
+// natsSubjectCovers checks if all the subjects matched by subject (with its wildcards)
+// are matched by pattern.
+func natsSubjectCovers(pattern string, subject string) bool {
+	patterns, words := strings.Split(pattern, "."), strings.Split(subject, ".")
+	for i, p := range patterns {
+		switch {
+		case p == ">":
+			return len(words) > i
+		case i >= len(words) || words[i] == ">":
+			return false
+		case p != "*" && p != words[i]:
+			return false
+		}
+	}
+	return len(patterns) == len(words)
+}
+
+// natsUncoveredSubjects returns the subjects not covered by another one, so that
+// overlapping bindings do not add subscriptions.
+func natsUncoveredSubjects(subjects []string) []string {
+	uncovered := []string{}
+	for i, subject := range subjects {
+		covered := false
+		for j, pattern := range subjects {
+			if i != j && natsSubjectCovers(pattern, subject) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			uncovered = append(uncovered, subject)
+		}
+	}
+	return uncovered
+}
+
+// Connect connects to the NATS server. The connection is automatically recovered.
+func (nt *NATSTransport) Connect() error {
+	opts := []nats.Option{nats.MaxReconnects(-1)}
+	if nt.Name != "" {
+		opts = append(opts, nats.Name(nt.Name))
+	}
+
+	conn, err := nats.Connect(nt.URL, opts...)
+	if err != nil {
+		return err
+	}
+	nt.Conn = conn
+	return nil
+}
+
+// Close stops all the subscribers and closes the NATS connection.
+func (nt *NATSTransport) Close() error {
+	for _, sub := range nt.Subscribers {
+		sub.Stop()
+	}
+	if nt.Conn != nil {
+		nt.Conn.Close()
+	}
+	return nil
+}
+
+// EventPublisher returns the "name"-publisher as an EventPublisher.
+func (nt *NATSTransport) EventPublisher(name string) (EventPublisher, error) {
+	if pub, ok := nt.Publishers[name]; ok {
+		return pub, nil
+	}
+	return nil, fmt.Errorf("no configuration found for publisher '%s'", name)
+}
+
+// EventSubscriber returns the "name"-subscriber as an EventSubscriber.
+func (nt *NATSTransport) EventSubscriber(name string) (EventSubscriber, error) {
+	if sub, ok := nt.Subscribers[name]; ok {
+		return sub, nil
+	}
+	return nil, fmt.Errorf("no configuration found for subscriber '%s'", name)
+}
+
+// publish publishes the message on the subject.
+func (nt *NATSTransport) publish(subject string, headers map[string]string, body []byte) error {
+	if nt.Conn == nil {
+		return ErrTransportNotConnected
+	}
+
+	msg := nats.NewMsg(subject)
+	for k, v := range headers {
+		msg.Header.Set(k, v)
+	}
+	msg.Data = body
+	return nt.Conn.PublishMsg(msg)
+}
+
+// Publish publishes the event on the publisher subject.
+func (pub *NATSPublisher) Publish(event Event) error {
+	headers, body, err := encodeMessage(event, pub.Format, pub.ContentType, pub.ContentEncoding)
+	if err != nil {
+		return err
+	}
+	return pub.Transport.publish(pub.Subject, headers, body)
+}
+
+// Handle sets the subscriber event handler.
+func (sub *NATSSubscriber) Handle(handler EventHandler) {
+	sub.mu.Lock()
+	sub.handler = handler
+	sub.mu.Unlock()
+}
+
+// Start subscribes to the subscriber subjects and starts handling the received events in a goroutine.
+func (sub *NATSSubscriber) Start() error {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	if sub.stop != nil {
+		return nil
+	}
+	if sub.handler == nil {
+		return ErrNoEventHandler
+	}
+	if sub.Transport.Conn == nil {
+		return ErrTransportNotConnected
+	}
+
+	pending := sub.Pending
+	if pending <= 0 {
+		pending = DefaultNATSPending
+	}
+	messages := make(chan *nats.Msg, pending)
+	for _, subject := range sub.Subjects {
+		s, err := sub.Transport.Conn.ChanQueueSubscribe(subject, sub.Queue, messages)
+		if err != nil {
+			sub.unsubscribe()
+			return err
+		}
+		sub.subscriptions = append(sub.subscriptions, s)
+	}
+	// events published once Start returns are received
+	if err := sub.Transport.Conn.Flush(); err != nil {
+		sub.unsubscribe()
+		return err
+	}
+
+	sub.stop = make(chan struct{})
+	sub.done = make(chan struct{})
+	go sub.run(messages, sub.handler, sub.stop, sub.done)
+
+	return nil
+}
+
+// Stop unsubscribes and waits for the event being handled, if any.
+// Received events not yet handled are lost.
+func (sub *NATSSubscriber) Stop() error {
+	sub.mu.Lock()
+	stop, done := sub.stop, sub.done
+	sub.stop, sub.done = nil, nil
+	sub.unsubscribe()
+	sub.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	return nil
+}
+
+// unsubscribe removes the subscriptions. Must be called holding mu.
+func (sub *NATSSubscriber) unsubscribe() {
+	for _, s := range sub.subscriptions {
+		s.Unsubscribe()
+	}
+	sub.subscriptions = nil
+}
+
+func (sub *NATSSubscriber) run(messages chan *nats.Msg, handler EventHandler, stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	for {
+		select {
+		case <-stop:
+			return
+		case msg := <-messages:
+			sub.handle(handler, msg)
+		}
+	}
+}
+
+// handle decodes and dispatches the event, retrying failed events with delay or dead-lettering them.
+func (sub *NATSSubscriber) handle(handler EventHandler, msg *nats.Msg) {
+	headers := map[string]string{}
+	for k := range msg.Header {
+		headers[k] = msg.Header.Get(k)
+	}
+
+	event, err := decodeMessage(headers, msg.Data)
+	if err == nil {
+		err = dispatchEvent(context.Background(), sub.Name, sub.Dedup, handler, event)
+		if err == nil || err == ErrDuplicateEvent {
+			return
+		}
+	}
+	log.Printf("subscriber %s: error handling message from subject %s: %s", sub.Name, msg.Subject, err)
+
+	if unprocessable(err) || event.Name == "" {
+		sub.deadLetter(msg.Subject, headers, msg.Data, err)
+		return
+	}
+
+	headers[HeaderFailureReason] = err.Error()
+	if sub.MaxAttempts <= 0 {
+		if perr := sub.Transport.publish(sub.Queue, headers, msg.Data); perr != nil {
+			log.Printf("subscriber %s: unable to requeue message: %s", sub.Name, perr)
+		}
+		return
+	}
+
+	attempts := headerRetryCount(headers)
+	if attempts >= sub.MaxAttempts {
+		sub.deadLetter(msg.Subject, headers, msg.Data, err)
+		return
+	}
+
+	headers[HeaderRetryCount] = strconv.Itoa(attempts + 1)
+	time.AfterFunc(retryDelay(sub.RetryDelays, attempts), func() {
+		if perr := sub.Transport.publish(sub.Queue, headers, msg.Data); perr != nil {
+			log.Printf("subscriber %s: unable to retry message: %s", sub.Name, perr)
+		}
+	})
+}
+
+// deadLetter publishes the failed message to the subscriber dead letter exchange, if any.
+func (sub *NATSSubscriber) deadLetter(subject string, headers map[string]string, body []byte, cause error) {
+	if sub.DeadLetterExchange == "" {
+		log.Printf("subscriber %s: dropping message from subject %s", sub.Name, subject)
+		return
+	}
+
+	headers[HeaderFailureReason] = cause.Error()
+	headers[HeaderFailedQueue] = sub.Queue
+	if err := sub.Transport.publish(natsSubject(sub.DeadLetterExchange, sub.DeadLetterRoutingKey), headers, body); err != nil {
+		log.Printf("subscriber %s: unable to dead-letter message: %s", sub.Name, err)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2019 Luca Stasio <joshuagame@gmail.com>
+// Copyright 2019 IT Resources s.r.l.
+//
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package sgul
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/test"
+)
+
+// transportTest is a subscriber failing the first failures events (all of them if negative),
+// retried up to maxAttempts times.
+type transportTest struct {
+	name        string
+	maxAttempts int
+	delays      []time.Duration
+	failures    int
+	wantCalls   int
+	wantDead    bool
+}
+
+var transportTests = []transportTest{
+	{"overlapping bindings", 0, nil, 0, 1, false},
+	{"requeue without max attempts", 0, nil, 2, 3, false},
+	{"retry", 3, []time.Duration{10 * time.Millisecond}, 2, 3, false},
+	{"dead letter after max attempts", 1, []time.Duration{10 * time.Millisecond}, -1, 2, true},
+}
+
+// transportTopology returns the test topology: the orders queue is bound to the
+// events topic exchange with overlapping routing keys, failed events are dead-lettered
+// through the dlx fanout exchange to the dead queue.
+func transportTopology(tt transportTest) AMQP {
+	var conf AMQP
+	conf.Exchanges = []Exchange{{Name: "events", Type: "topic"}, {Name: "dlx", Type: "fanout"}}
+	conf.Queues = []Queue{{Name: "orders"}, {Name: "dead"}}
+	conf.Bindings = []Binding{
+		{Exchange: "events", Queue: "orders", RoutingKeys: []string{"order.*", "*.created", "#"}},
+		{Exchange: "dlx", Queue: "dead"},
+	}
+	conf.Publishers = []Publisher{{Name: "orders", Exchange: "events", RoutingKey: "order.created"}}
+
+	orders := Subscriber{Name: "orders", Queue: "orders"}
+	orders.Retry.MaxAttempts = tt.maxAttempts
+	orders.Retry.Delays = tt.delays
+	orders.Retry.DeadLetterExchange = "dlx"
+	conf.Subscribers = []Subscriber{orders, {Name: "dead", Queue: "dead"}}
+	return conf
+}
+
+// runTransportTest publishes an event with the orders publisher and checks the
+// orders subscriber calls and the dead queue.
+func runTransportTest(t *testing.T, tt transportTest, transport EventTransport) {
+	t.Helper()
+
+	var mu sync.Mutex
+	calls := 0
+	handled := make(chan struct{}, 16)
+	dead := make(chan Event, 1)
+
+	orders, err := transport.EventSubscriber("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orders.Handle(func(ctx context.Context, event Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		handled <- struct{}{}
+		if tt.failures < 0 || calls <= tt.failures {
+			return errors.New("handler failure")
+		}
+		return nil
+	})
+	deadSub, err := transport.EventSubscriber("dead")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadSub.Handle(func(ctx context.Context, event Event) error {
+		dead <- event
+		return nil
+	})
+	for _, sub := range []EventSubscriber{orders, deadSub} {
+		if err := sub.Start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pub, err := transport.EventPublisher("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := NewEvent("OrderCreated", "orders", map[string]interface{}{"id": 1})
+	if err := pub.Publish(event); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < tt.wantCalls; i++ {
+		select {
+		case <-handled:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("handler called %d times, want %d", i, tt.wantCalls)
+		}
+	}
+	if tt.wantDead {
+		select {
+		case got := <-dead:
+			if got.ID != event.ID {
+				t.Errorf("dead-lettered event ID = %s, want %s", got.ID, event.ID)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("event not dead-lettered")
+		}
+	}
+
+	// no further deliveries
+	time.Sleep(200 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != tt.wantCalls {
+		t.Errorf("handler called %d times, want %d", calls, tt.wantCalls)
+	}
+	if !tt.wantDead && len(dead) > 0 {
+		t.Error("event dead-lettered")
+	}
+}
+
+func TestNATSTransport(t *testing.T) {
+	for _, tt := range transportTests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := natsserver.RunRandClientPortServer()
+			defer server.Shutdown()
+
+			var events Events
+			events.NATS.URL = server.ClientURL()
+			transport, err := newNATSTransport(events, transportTopology(tt))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := transport.Connect(); err != nil {
+				t.Fatal(err)
+			}
+			defer transport.Close()
+
+			runTransportTest(t, tt, transport)
+		})
+	}
+}
+
+func TestNATSUncoveredSubjects(t *testing.T) {
+	tests := []struct {
+		name     string
+		subjects []string
+		want     []string
+	}{
+		{"fanout", []string{"orders", "events", "events.>"}, []string{"orders", "events", "events.>"}},
+		{"overlapping topic bindings", []string{"orders", "events.order.*", "events.*.created", "events", "events.>"}, []string{"orders", "events", "events.>"}},
+		{"single word wildcards", []string{"events.*.created", "events.*.*", "events.order.*"}, []string{"events.*.*"}},
+		{"queue covered by a binding", []string{"events.orders", "events.*"}, []string{"events.*"}},
+		{"disjoint", []string{"events.order.*", "events.*.created"}, []string{"events.order.*", "events.*.created"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := natsUncoveredSubjects(tt.subjects); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("natsUncoveredSubjects() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,283 @@
+// Copyright 2019 Luca Stasio <joshuagame@gmail.com>
+// Copyright 2019 IT Resources s.r.l.
+//
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package sgul defines common structures and functionalities for applications.
+// outbox.go defines the transactional outbox to publish events written in gorm transactions.
+package sgul
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Outbox relay defaults.
+const (
+	DefaultOutboxInterval       = 1 * time.Second
+	DefaultOutboxBatchSize      = 100
+	DefaultOutboxConfirmTimeout = 5 * time.Second
+	DefaultOutboxMaxAttempts    = 10
+	DefaultOutboxLeaseTTL       = 30 * time.Second
+)
+
+// outboxLeaseName is the name of the outbox table lease.
+const outboxLeaseName = "sgul_outbox"
+
+// OutboxMessage is an event enqueued in the transactional outbox, waiting to be published.
+// Events that can never be published (unknown publisher, invalid event or too many
+// failed attempts) are parked with FailedAt set and are no more relayed.
+type OutboxMessage struct {
+	ID        uint   `gorm:"primary_key"`
+	Publisher string `gorm:"size:255;not null"`
+	Event     string `gorm:"type:text;not null"`
+	CreatedAt time.Time
+	SentAt    *time.Time `gorm:"index"`
+	FailedAt  *time.Time `gorm:"index"`
+	Attempts  int
+	LastError string `gorm:"type:text"`
+}
+
+// TableName returns the outbox table name.
+func (OutboxMessage) TableName() string {
+	return "sgul_outbox"
+}
+
+// OutboxLease is the lease on the outbox held by the relay allowed to relay events.
+type OutboxLease struct {
+	Name      string `gorm:"primary_key;size:255"`
+	Owner     string `gorm:"size:255;not null"`
+	ExpiresAt time.Time
+}
+
+// TableName returns the outbox lease table name.
+func (OutboxLease) TableName() string {
+	return "sgul_outbox_lease"
+}
+
+// MigrateOutbox creates (or updates) the outbox and the outbox lease tables.
+func MigrateOutbox(db *gorm.DB) error {
+	return db.AutoMigrate(&OutboxMessage{}, &OutboxLease{}).Error
+}
+
+// EnqueueEvent enqueues an event into the outbox, to be published later by the
+// OutboxRelay with the "publisher"-publisher. Call it with the transaction of
+// GormRepository.DoInTransaction so that the event is stored only if the
+// transaction commits.
+func EnqueueEvent(tx *gorm.DB, publisher string, event Event) error {
+	if event.ID == "" {
+		// the event is published with the same ID on each relay attempt
+		event.ID = newUUID()
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return tx.Create(&OutboxMessage{
+		Publisher: publisher,
+		Event:     string(payload),
+	}).Error
+}
+
+// OutboxRelay publishes the outbox events, in order, through AMQP publishers
+// with broker confirmation, and marks them as sent.
+// Events are published at least once: an event could be published again if the
+// relay stops after the publication and before marking it as sent.
+// Many relays can run on an outbox table (a.e. one for each service instance):
+// only the one holding the outbox lease relays events.
+type OutboxRelay struct {
+	db             *gorm.DB
+	conn           *AMQPConnection
+	interval       time.Duration
+	batchSize      int
+	confirmTimeout time.Duration
+	maxAttempts    int
+	leaseTTL       time.Duration
+	owner          string
+
+	mu   *sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewOutboxRelay returns a new OutboxRelay instance configured with the AMQP Outbox configuration.
+func NewOutboxRelay(db *gorm.DB, conn *AMQPConnection) *OutboxRelay {
+	relay := &OutboxRelay{
+		db:             db,
+		conn:           conn,
+		interval:       DefaultOutboxInterval,
+		batchSize:      DefaultOutboxBatchSize,
+		confirmTimeout: DefaultOutboxConfirmTimeout,
+		maxAttempts:    DefaultOutboxMaxAttempts,
+		leaseTTL:       DefaultOutboxLeaseTTL,
+		owner:          newUUID(),
+		mu:             &sync.Mutex{},
+	}
+
+	if conn.conf.Outbox.Interval > 0 {
+		relay.interval = conn.conf.Outbox.Interval
+	}
+	if conn.conf.Outbox.BatchSize > 0 {
+		relay.batchSize = conn.conf.Outbox.BatchSize
+	}
+	if conn.conf.Outbox.ConfirmTimeout > 0 {
+		relay.confirmTimeout = conn.conf.Outbox.ConfirmTimeout
+	}
+	if conn.conf.Outbox.MaxAttempts > 0 {
+		relay.maxAttempts = conn.conf.Outbox.MaxAttempts
+	}
+	if conn.conf.Outbox.LeaseTTL > 0 {
+		relay.leaseTTL = conn.conf.Outbox.LeaseTTL
+	}
+
+	return relay
+}
+
+// Start starts relaying outbox events at regular intervals.
+func (r *OutboxRelay) Start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stop != nil {
+		return
+	}
+
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	go r.run(r.stop, r.done)
+}
+
+// Stop stops relaying, waits for the current relay pass to end and releases the outbox lease.
+func (r *OutboxRelay) Stop() {
+	r.mu.Lock()
+	stop, done := r.stop, r.done
+	r.stop, r.done = nil, nil
+	r.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+		r.db.Model(&OutboxLease{}).
+			Where("name = ? AND owner = ?", outboxLeaseName, r.owner).
+			Update("expires_at", time.Now())
+	}
+}
+
+func (r *OutboxRelay) run(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	for {
+		if _, err := r.Relay(context.Background()); err != nil {
+			log.Printf("outbox relay: %s", err)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(r.interval):
+		}
+	}
+}
+
+// Relay publishes a batch of pending outbox events, in order, and returns the number of sent events.
+// It does nothing if another relay holds the outbox lease.
+// It stops at the first failure, so that events are never published out of order, unless
+// the event is parked: it can never be published or it failed MaxAttempts times.
+func (r *OutboxRelay) Relay(ctx context.Context) (int, error) {
+	var messages []OutboxMessage
+	if err := r.db.Where("sent_at IS NULL AND failed_at IS NULL").Order("id").Limit(r.batchSize).Find(&messages).Error; err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, m := range messages {
+		// the lease is renewed before each event, so that it does not expire on long passes
+		leased, err := r.lease()
+		if err != nil || !leased {
+			return sent, err
+		}
+
+		if poison, err := r.publish(ctx, m); err != nil {
+			updates := map[string]interface{}{
+				"attempts":   gorm.Expr("attempts + 1"),
+				"last_error": err.Error(),
+			}
+			// broker outages do not count towards parking
+			if poison || (!r.conn.publisher(m.Publisher).isOutage(err) && m.Attempts+1 >= r.maxAttempts) {
+				log.Printf("outbox relay: parking outbox event %d: %s", m.ID, err)
+				updates["failed_at"] = time.Now()
+				if uerr := r.db.Model(&m).Updates(updates).Error; uerr != nil {
+					return sent, fmt.Errorf("unable to park outbox event %d: %s", m.ID, uerr)
+				}
+				continue
+			}
+			if uerr := r.db.Model(&m).Updates(updates).Error; uerr != nil {
+				log.Printf("outbox relay: unable to update outbox event %d: %s", m.ID, uerr)
+			}
+			return sent, fmt.Errorf("unable to publish outbox event %d: %s", m.ID, err)
+		}
+
+		if err := r.db.Model(&m).Update("sent_at", time.Now()).Error; err != nil {
+			return sent, err
+		}
+		sent++
+	}
+
+	return sent, nil
+}
+
+// lease acquires (or renews) the outbox lease for this relay.
+// It returns false if the lease is held by another relay.
+func (r *OutboxRelay) lease() (bool, error) {
+	now := time.Now()
+	result := r.db.Model(&OutboxLease{}).
+		Where("name = ? AND (owner = ? OR expires_at < ?)", outboxLeaseName, r.owner, now).
+		Updates(map[string]interface{}{"owner": r.owner, "expires_at": now.Add(r.leaseTTL)})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected > 0 {
+		return true, nil
+	}
+
+	// some databases (a.e. MySQL) report no affected rows when a renewal writes the same
+	// values (same second): the lease is re-read to tell it from a lease held by another relay
+	var current OutboxLease
+	err := r.db.Where("name = ?", outboxLeaseName).First(&current).Error
+	if err == nil {
+		return current.Owner == r.owner && !current.ExpiresAt.Before(now), nil
+	}
+	if !gorm.IsRecordNotFoundError(err) {
+		return false, err
+	}
+
+	// first relay ever: the primary key makes a concurrent creation fail
+	if err := r.db.Create(&OutboxLease{Name: outboxLeaseName, Owner: r.owner, ExpiresAt: now.Add(r.leaseTTL)}).Error; err != nil {
+		return false, nil
+	}
+	return true, nil
+}
+
+// publish publishes an outbox event waiting for the broker confirmation.
+// It reports if the event can never be published (poison): unknown publisher or invalid event.
+func (r *OutboxRelay) publish(ctx context.Context, m OutboxMessage) (bool, error) {
+	publisher := r.conn.publisher(m.Publisher)
+	if publisher == nil {
+		return true, fmt.Errorf("no publisher found with name '%s'", m.Publisher)
+	}
+
+	var event Event
+	if err := json.Unmarshal([]byte(m.Event), &event); err != nil {
+		return true, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.confirmTimeout)
+	defer cancel()
+	return false, publisher.PublishWithConfirm(ctx, event)
+}
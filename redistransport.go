@@ -0,0 +1,518 @@
+// Copyright 2019 Luca Stasio <joshuagame@gmail.com>
+// Copyright 2019 IT Resources s.r.l.
+//
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package sgul defines common structures and functionalities for applications.
+// redistransport.go defines the Redis Streams events transport.
+package sgul
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/itross/sgul/backoff"
+)
+
+// Redis Streams transport defaults.
+const (
+	DefaultRedisAddr   = "localhost:6379"
+	DefaultRedisPrefix = "sgul:"
+	DefaultRedisBlock  = 5 * time.Second
+	DefaultRedisCount  = 10
+)
+
+// Redis Streams message fields.
+const (
+	redisFieldBody       = "body"
+	redisFieldRoutingKey = "routing-key"
+	redisFieldHeader     = "header:"
+)
+
+type (
+	// RedisTransport is the Redis Streams events transport. The AMQP configuration topology is
+	// mapped on streams: publishers add events to their exchange stream (or to the queue stream
+	// for the default exchange) and subscribers read, in a consumer group named after their queue,
+	// the streams of the exchanges their queue is bound to, filtering events by routing key.
+	// Consumer groups are created on Connect, so that events published from then on are kept
+	// for subscribers not yet started. Events are acked once handled, retried or dead-lettered:
+	// pending events are handled again when the subscriber restarts.
+	RedisTransport struct {
+		Client      *redis.Client
+		Prefix      string
+		MaxLen      int64
+		Block       time.Duration
+		Publishers  map[string]*RedisPublisher
+		Subscribers map[string]*RedisSubscriber
+		options     *redis.Options
+		backoff     backoff.Policy
+	}
+
+	// RedisPublisher adds events to a Redis stream.
+	RedisPublisher struct {
+		Transport       *RedisTransport
+		Name            string
+		Stream          string
+		RoutingKey      string
+		ContentType     string
+		ContentEncoding string
+		Format          string
+	}
+
+	// RedisSubscriber reads events from Redis streams in a consumer group.
+	// Failed events are added again to the queue stream, with delay, up to MaxAttempts times,
+	// then they are dead-lettered to DeadLetterExchange (if any) or dropped. With no MaxAttempts,
+	// failed events are added again to the queue stream straight away, as AMQP subscribers requeue them.
+	RedisSubscriber struct {
+		Transport            *RedisTransport
+		Name                 string
+		Queue                string
+		Consumer             string
+		Count                int
+		MaxAttempts          int
+		RetryDelays          []time.Duration
+		DeadLetterExchange   string
+		DeadLetterRoutingKey string
+		Dedup                DedupStore
+
+		// bindings are the exchanges bindings by stream (nil for the queue stream)
+		bindings map[string][]redisBinding
+		handler  EventHandler
+		mu       *sync.Mutex
+		stop     chan struct{}
+		done     chan struct{}
+	}
+
+	redisBinding struct {
+		extype string
+		key    string
+	}
+)
+
+// NewRedisTransport returns a new Redis Streams transport configured with the Events.Redis
+// configuration and the publishers and subscribers of the AMQP configuration.
+func NewRedisTransport() (*RedisTransport, error) {
+	return newRedisTransport(GetConfiguration().Events, GetConfiguration().AMQP)
+}
+
+// newRedisTransport returns a new Redis Streams transport for the events and AMQP configurations.
+func newRedisTransport(events Events, amqpConf AMQP) (*RedisTransport, error) {
+	conf := events.Redis
+	rt := &RedisTransport{
+		Prefix:      conf.Prefix,
+		MaxLen:      conf.MaxLen,
+		Block:       conf.Block,
+		Publishers:  make(map[string]*RedisPublisher),
+		Subscribers: make(map[string]*RedisSubscriber),
+		options: &redis.Options{
+			Addr:     conf.Addr,
+			Password: conf.Password,
+			DB:       conf.DB,
+		},
+		backoff: backoff.Policy{
+			InitialInterval: conf.Reconnect.InitialInterval,
+			MaxInterval:     conf.Reconnect.MaxInterval,
+			Multiplier:      conf.Reconnect.Multiplier,
+			Jitter:          conf.Reconnect.Jitter,
+			NoJitter:        conf.Reconnect.NoJitter,
+		}.Merge(backoff.Default),
+	}
+	if rt.options.Addr == "" {
+		rt.options.Addr = DefaultRedisAddr
+	}
+	if rt.Prefix == "" {
+		rt.Prefix = DefaultRedisPrefix
+	}
+	if rt.Block <= 0 {
+		rt.Block = DefaultRedisBlock
+	}
+
+	for _, p := range amqpConf.Publishers {
+		stream := rt.exchangeStream(p.Exchange)
+		if p.Exchange == "" {
+			stream = rt.queueStream(p.RoutingKey)
+		}
+		rt.Publishers[p.Name] = &RedisPublisher{
+			Transport:       rt,
+			Name:            p.Name,
+			Stream:          stream,
+			RoutingKey:      p.RoutingKey,
+			ContentType:     p.ContentType,
+			ContentEncoding: p.ContentEncoding,
+			Format:          p.Format,
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	types := exchangeTypes(amqpConf)
+	for _, s := range amqpConf.Subscribers {
+		bindings := map[string][]redisBinding{rt.queueStream(s.Queue): nil}
+		for _, binding := range queueBindings(amqpConf, s.Queue) {
+			extype := types[binding.Exchange]
+			if extype != "direct" && extype != "fanout" && extype != "topic" {
+				return nil, fmt.Errorf("exchange '%s': type '%s' not supported by the redis transport", binding.Exchange, extype)
+			}
+
+			routingKeys := binding.RoutingKeys
+			if len(routingKeys) == 0 {
+				routingKeys = []string{""}
+			}
+			stream := rt.exchangeStream(binding.Exchange)
+			for _, key := range routingKeys {
+				bindings[stream] = append(bindings[stream], redisBinding{extype: extype, key: key})
+			}
+		}
+
+		var dedup DedupStore
+		if s.Dedup.Enabled {
+			dedup = NewMemoryDedupStore(s.Dedup.Size, s.Dedup.TTL)
+		}
+		rt.Subscribers[s.Name] = &RedisSubscriber{
+			Transport:            rt,
+			Name:                 s.Name,
+			Queue:                s.Queue,
+			Consumer:             fmt.Sprintf("%s-%s", s.Name, hostname),
+			Count:                s.Prefetch,
+			MaxAttempts:          s.Retry.MaxAttempts,
+			RetryDelays:          s.Retry.Delays,
+			DeadLetterExchange:   s.Retry.DeadLetterExchange,
+			DeadLetterRoutingKey: s.Retry.DeadLetterRoutingKey,
+			Dedup:                dedup,
+			bindings:             bindings,
+			mu:                   &sync.Mutex{},
+		}
+	}
+
+	return rt, nil
+}
+
+// exchangeStream returns the stream name for an exchange.
+func (rt *RedisTransport) exchangeStream(exchange string) string {
+	return rt.Prefix + "exchange:" + exchange
+}
+
+// queueStream returns the stream name for a queue.
+func (rt *RedisTransport) queueStream(queue string) string {
+	return rt.Prefix + "queue:" + queue
+}
+
+// Connect connects to the Redis server and creates the subscribers consumer groups, if needed.
+func (rt *RedisTransport) Connect() error {
+	client := redis.NewClient(rt.options)
+	if err := client.Ping().Err(); err != nil {
+		client.Close()
+		return err
+	}
+
+	for _, sub := range rt.Subscribers {
+		if err := sub.createGroups(client); err != nil {
+			client.Close()
+			return err
+		}
+	}
+
+	rt.Client = client
+	return nil
+}
+
+// createGroups creates the subscriber consumer group on its streams, creating the streams
+// if needed. Groups are created at the end of the streams, existing groups are left as they are.
+func (sub *RedisSubscriber) createGroups(client *redis.Client) error {
+	for stream := range sub.bindings {
+		err := client.XGroupCreateMkStream(stream, sub.Queue, "$").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops all the subscribers and closes the Redis client.
+func (rt *RedisTransport) Close() error {
+	for _, sub := range rt.Subscribers {
+		sub.Stop()
+	}
+	if rt.Client != nil {
+		return rt.Client.Close()
+	}
+	return nil
+}
+
+// EventPublisher returns the "name"-publisher as an EventPublisher.
+func (rt *RedisTransport) EventPublisher(name string) (EventPublisher, error) {
+	if pub, ok := rt.Publishers[name]; ok {
+		return pub, nil
+	}
+	return nil, fmt.Errorf("no configuration found for publisher '%s'", name)
+}
+
+// EventSubscriber returns the "name"-subscriber as an EventSubscriber.
+func (rt *RedisTransport) EventSubscriber(name string) (EventSubscriber, error) {
+	if sub, ok := rt.Subscribers[name]; ok {
+		return sub, nil
+	}
+	return nil, fmt.Errorf("no configuration found for subscriber '%s'", name)
+}
+
+// add adds the message to the stream.
+func (rt *RedisTransport) add(stream string, routingKey string, headers map[string]string, body []byte) error {
+	if rt.Client == nil {
+		return ErrTransportNotConnected
+	}
+
+	values := map[string]interface{}{
+		redisFieldBody:       body,
+		redisFieldRoutingKey: routingKey,
+	}
+	for k, v := range headers {
+		values[redisFieldHeader+k] = v
+	}
+	return rt.Client.XAdd(&redis.XAddArgs{
+		Stream:       stream,
+		MaxLenApprox: rt.MaxLen,
+		Values:       values,
+	}).Err()
+}
+
+// Publish adds the event to the publisher stream.
+func (pub *RedisPublisher) Publish(event Event) error {
+	headers, body, err := encodeMessage(event, pub.Format, pub.ContentType, pub.ContentEncoding)
+	if err != nil {
+		return err
+	}
+	return pub.Transport.add(pub.Stream, pub.RoutingKey, headers, body)
+}
+
+// Handle sets the subscriber event handler.
+func (sub *RedisSubscriber) Handle(handler EventHandler) {
+	sub.mu.Lock()
+	sub.handler = handler
+	sub.mu.Unlock()
+}
+
+// Start starts reading events in a goroutine.
+func (sub *RedisSubscriber) Start() error {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	if sub.stop != nil {
+		return nil
+	}
+	if sub.handler == nil {
+		return ErrNoEventHandler
+	}
+	if sub.Transport.Client == nil {
+		return ErrTransportNotConnected
+	}
+
+	sub.stop = make(chan struct{})
+	sub.done = make(chan struct{})
+	go sub.run(sub.handler, sub.stop, sub.done)
+
+	return nil
+}
+
+// Stop stops reading events and waits for the events being handled, if any.
+// It can take up to the transport Block duration.
+func (sub *RedisSubscriber) Stop() error {
+	sub.mu.Lock()
+	stop, done := sub.stop, sub.done
+	sub.stop, sub.done = nil, nil
+	sub.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	return nil
+}
+
+// run reads and handles events till stop is closed. Pending events of the consumer
+// (read but not acked before a restart) are handled first.
+func (sub *RedisSubscriber) run(handler EventHandler, stop chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	streams := make([]string, 0, len(sub.bindings))
+	for stream := range sub.bindings {
+		streams = append(streams, stream)
+	}
+	ids := make([]string, len(streams))
+	for i := range ids {
+		ids[i] = "0"
+	}
+
+	count := sub.Count
+	if count <= 0 {
+		count = DefaultRedisCount
+	}
+
+	for attempt := 1; ; {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		result, err := sub.Transport.Client.XReadGroup(&redis.XReadGroupArgs{
+			Group:    sub.Queue,
+			Consumer: sub.Consumer,
+			Streams:  append(append([]string{}, streams...), ids...),
+			Count:    int64(count),
+			Block:    sub.Transport.Block,
+		}).Result()
+		if err != nil && err != redis.Nil {
+			log.Printf("subscriber %s: unable to read from streams: %s", sub.Name, err)
+			if strings.HasPrefix(err.Error(), "NOGROUP") {
+				// the streams or the group have been deleted (a.e. on a server restart without persistence)
+				if gerr := sub.createGroups(sub.Transport.Client); gerr != nil {
+					log.Printf("subscriber %s: unable to create consumer groups: %s", sub.Name, gerr)
+				}
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(sub.Transport.backoff.Duration(attempt)):
+			}
+			attempt++
+			continue
+		}
+		attempt = 1
+
+		pending := false
+		for _, stream := range result {
+			for _, msg := range stream.Messages {
+				pending = true
+				sub.handle(handler, stream.Stream, msg)
+			}
+			// pending events are left pending while their retry is scheduled: read past them
+			if len(stream.Messages) > 0 && ids[0] != ">" {
+				for i := range streams {
+					if streams[i] == stream.Stream {
+						ids[i] = stream.Messages[len(stream.Messages)-1].ID
+					}
+				}
+			}
+		}
+
+		if !pending {
+			// no more pending events: read new ones
+			for i := range ids {
+				ids[i] = ">"
+			}
+		}
+	}
+}
+
+// handle decodes and dispatches the event if its routing key matches the stream bindings,
+// retrying failed events with delay or dead-lettering them. The message is acked once handled
+// or once its retry or dead-letter copy is added: otherwise it is left pending.
+func (sub *RedisSubscriber) handle(handler EventHandler, stream string, msg redis.XMessage) {
+	ack := func() {
+		if err := sub.Transport.Client.XAck(stream, sub.Queue, msg.ID).Err(); err != nil {
+			log.Printf("subscriber %s: unable to ack message %s: %s", sub.Name, msg.ID, err)
+		}
+	}
+
+	routingKey, _ := msg.Values[redisFieldRoutingKey].(string)
+	if !sub.matches(stream, routingKey) {
+		ack()
+		return
+	}
+
+	body, _ := msg.Values[redisFieldBody].(string)
+	headers := map[string]string{}
+	for field, value := range msg.Values {
+		if strings.HasPrefix(field, redisFieldHeader) {
+			headers[strings.TrimPrefix(field, redisFieldHeader)], _ = value.(string)
+		}
+	}
+
+	event, err := decodeMessage(headers, []byte(body))
+	if err == nil {
+		err = dispatchEvent(context.Background(), sub.Name, sub.Dedup, handler, event)
+		if err == nil || err == ErrDuplicateEvent {
+			ack()
+			return
+		}
+	}
+	log.Printf("subscriber %s: error handling message %s from stream %s: %s", sub.Name, msg.ID, stream, err)
+
+	if unprocessable(err) || event.Name == "" {
+		if sub.deadLetter(routingKey, headers, []byte(body), err) {
+			ack()
+		}
+		return
+	}
+
+	headers[HeaderFailureReason] = err.Error()
+	if sub.MaxAttempts <= 0 {
+		sub.retry(msg.ID, routingKey, headers, []byte(body), ack)
+		return
+	}
+
+	attempts := headerRetryCount(headers)
+	if attempts >= sub.MaxAttempts {
+		if sub.deadLetter(routingKey, headers, []byte(body), err) {
+			ack()
+		}
+		return
+	}
+
+	headers[HeaderRetryCount] = strconv.Itoa(attempts + 1)
+	time.AfterFunc(retryDelay(sub.RetryDelays, attempts), func() {
+		sub.retry(msg.ID, routingKey, headers, []byte(body), ack)
+	})
+}
+
+// retry adds the failed message again to the queue stream and acks the original one.
+// If the message cannot be added, the original one is left pending.
+func (sub *RedisSubscriber) retry(id string, routingKey string, headers map[string]string, body []byte, ack func()) {
+	if err := sub.Transport.add(sub.Transport.queueStream(sub.Queue), routingKey, headers, body); err != nil {
+		log.Printf("subscriber %s: unable to retry message %s: %s", sub.Name, id, err)
+		return
+	}
+	ack()
+}
+
+// matches checks if the routing key matches one of the stream bindings.
+// The queue stream has no bindings and always matches.
+func (sub *RedisSubscriber) matches(stream string, routingKey string) bool {
+	bindings := sub.bindings[stream]
+	if bindings == nil {
+		return true
+	}
+	for _, binding := range bindings {
+		if routingKeyMatches(binding.extype, binding.key, routingKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// deadLetter adds the failed message to the subscriber dead letter exchange stream, if any.
+// It returns false if the message could not be added.
+func (sub *RedisSubscriber) deadLetter(routingKey string, headers map[string]string, body []byte, cause error) bool {
+	if sub.DeadLetterExchange == "" {
+		log.Printf("subscriber %s: dropping message from queue %s", sub.Name, sub.Queue)
+		return true
+	}
+
+	if sub.DeadLetterRoutingKey != "" {
+		routingKey = sub.DeadLetterRoutingKey
+	}
+	headers[HeaderFailureReason] = cause.Error()
+	headers[HeaderFailedQueue] = sub.Queue
+	if err := sub.Transport.add(sub.Transport.exchangeStream(sub.DeadLetterExchange), routingKey, headers, body); err != nil {
+		log.Printf("subscriber %s: unable to dead-letter message: %s", sub.Name, err)
+		return false
+	}
+	return true
+}
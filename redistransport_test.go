@@ -0,0 +1,136 @@
+// Copyright 2019 Luca Stasio <joshuagame@gmail.com>
+// Copyright 2019 IT Resources s.r.l.
+//
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package sgul
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newTestRedisTransport returns a Redis transport connected to a new miniredis server.
+func newTestRedisTransport(t *testing.T, amqpConf AMQP) (*RedisTransport, func()) {
+	t.Helper()
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var events Events
+	events.Redis.Addr = server.Addr()
+	events.Redis.Block = 50 * time.Millisecond
+	transport, err := newRedisTransport(events, amqpConf)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	if err := transport.Connect(); err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return transport, func() {
+		transport.Close()
+		server.Close()
+	}
+}
+
+// assertNoPending checks that the subscriber acked all the messages of its streams.
+func assertNoPending(t *testing.T, sub *RedisSubscriber) {
+	t.Helper()
+	for stream := range sub.bindings {
+		pending, err := sub.Transport.Client.XPending(stream, sub.Queue).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pending.Count != 0 {
+			t.Errorf("stream %s: %d pending messages, want 0", stream, pending.Count)
+		}
+	}
+}
+
+func TestRedisTransport(t *testing.T) {
+	for _, tt := range transportTests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport, closeTransport := newTestRedisTransport(t, transportTopology(tt))
+			defer closeTransport()
+
+			runTransportTest(t, tt, transport)
+			assertNoPending(t, transport.Subscribers["orders"])
+		})
+	}
+}
+
+func TestRedisTransportPublishBeforeStart(t *testing.T) {
+	transport, closeTransport := newTestRedisTransport(t, transportTopology(transportTest{}))
+	defer closeTransport()
+
+	event := NewEvent("OrderCreated", "orders", map[string]interface{}{"id": 1})
+	if err := transport.Publishers["orders"].Publish(event); err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan Event, 1)
+	sub := transport.Subscribers["orders"]
+	sub.Handle(func(ctx context.Context, event Event) error {
+		received <- event
+		return nil
+	})
+	if err := sub.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case got := <-received:
+		if got.ID != event.ID {
+			t.Errorf("received event ID = %s, want %s", got.ID, event.ID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event published before the subscriber start not received")
+	}
+}
+
+func TestRedisTransportRecreatesDeletedGroups(t *testing.T) {
+	transport, closeTransport := newTestRedisTransport(t, transportTopology(transportTest{}))
+	defer closeTransport()
+
+	received := make(chan Event, 1)
+	sub := transport.Subscribers["orders"]
+	sub.Handle(func(ctx context.Context, event Event) error {
+		select {
+		case received <- event:
+		default:
+		}
+		return nil
+	})
+	if err := sub.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// deletes the streams along with the consumer groups
+	if err := transport.Client.FlushAll().Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// events published before the group is created again are not delivered
+	timeout := time.After(5 * time.Second)
+	for {
+		event := NewEvent("OrderCreated", "orders", map[string]interface{}{"id": 1})
+		if err := transport.Publishers["orders"].Publish(event); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-received:
+			return
+		case <-time.After(50 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("no event received after the consumer groups deletion")
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package registry
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// HMAC signature headers set by the HMACAuthenticator.
+const (
+	HeaderKeyID     = "X-Sgulreg-Key-Id"
+	HeaderTimestamp = "X-Sgulreg-Timestamp"
+	HeaderSignature = "X-Sgulreg-Signature"
+)
+
+// Authenticator adds credentials to each request sent to the service registry.
+type Authenticator interface {
+	Authenticate(req *http.Request, body []byte) error
+}
+
+// BearerAuthenticator authenticates requests with a static bearer token.
+type BearerAuthenticator struct {
+	Token string
+}
+
+// Authenticate sets the Authorization header with the bearer token.
+func (ba *BearerAuthenticator) Authenticate(req *http.Request, body []byte) error {
+	req.Header.Set("Authorization", "Bearer "+ba.Token)
+	return nil
+}
+
+// JWTAuthenticator authenticates requests with a bearer JWT token
+// signed (HS256) with a shared secret. A new short lived token is issued for each request.
+type JWTAuthenticator struct {
+	Secret     []byte
+	Subject    string
+	Expiration time.Duration
+}
+
+// Authenticate sets the Authorization header with a freshly signed JWT token.
+func (ja *JWTAuthenticator) Authenticate(req *http.Request, body []byte) error {
+	expiration := ja.Expiration
+	if expiration <= 0 {
+		expiration = time.Minute
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{
+		Subject:   ja.Subject,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(expiration).Unix(),
+	})
+
+	signed, err := token.SignedString(ja.Secret)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+signed)
+	return nil
+}
+
+// HMACAuthenticator signs requests with a shared secret.
+// The signature is the hex encoded HMAC-SHA256 of
+// "<method>\n<path>\n<timestamp>\n<body>".
+type HMACAuthenticator struct {
+	KeyID  string
+	Secret []byte
+}
+
+// Authenticate sets the key id, timestamp and signature headers.
+func (ha *HMACAuthenticator) Authenticate(req *http.Request, body []byte) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	mac := hmac.New(sha256.New, ha.Secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n", req.Method, req.URL.Path, timestamp)
+	mac.Write(body)
+
+	if ha.KeyID != "" {
+		req.Header.Set(HeaderKeyID, ha.KeyID)
+	}
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, hex.EncodeToString(mac.Sum(nil)))
+	return nil
+}
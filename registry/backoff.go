@@ -0,0 +1,10 @@
+package registry
+
+import "github.com/itross/sgul/backoff"
+
+// Backoff defines the exponential backoff policy used between two
+// registration retries.
+type Backoff = backoff.Policy
+
+// DefaultBackoff is the backoff policy used if none is set on the client.
+var DefaultBackoff = backoff.Default
@@ -3,6 +3,7 @@ package registry
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"sync"
@@ -12,22 +13,38 @@ import (
 // DefaultURL is the default SgulREG service url.
 const DefaultURL = "http://localhost:9687"
 
+// servicesPath is the SgulREG services API path.
+const servicesPath = "/sgulreg/services"
+
 // Client is the SgulREG API client.
 type Client struct {
-	url        string
-	httpClient *http.Client
-	req        ServiceRegistrationRequest
-	reqMux     *sync.RWMutex
-	registered bool
+	registries    []registryEndpoint
+	mode          Mode
+	registrations map[string]ServiceRegistrationResponse
+	httpClient    *http.Client
+	req           ServiceRegistrationRequest
+	reqMux        *sync.RWMutex
+	registered    bool
+	watching      bool
+	stop          chan struct{}
+	backoff       Backoff
+	auth          Authenticator
+	watchInterval time.Duration
+	status        RegistrationStatus
+	notify        []chan RegistrationStatus
 }
 
 // NewClient returns a new instance of the SgulREG API client.
 func NewClient(registryURL string) *Client {
 	return &Client{
-		url:        registryURL + "/sgulreg/services",
-		httpClient: http.DefaultClient,
-		reqMux:     &sync.RWMutex{},
-		registered: false,
+		registries:    []registryEndpoint{{origin: registryURL, url: registryURL + servicesPath}},
+		mode:          FailoverMode,
+		registrations: make(map[string]ServiceRegistrationResponse),
+		httpClient:    http.DefaultClient,
+		reqMux:        &sync.RWMutex{},
+		registered:    false,
+		backoff:       DefaultBackoff,
+		watchInterval: DefaultWatchInterval,
 	}
 }
 
@@ -38,62 +55,356 @@ func (c *Client) NewRequest(r ServiceRegistrationRequest) {
 	c.reqMux.Unlock()
 }
 
+// SetHTTPClient sets the http client used to call the service registry
+// (a.e. an http client configured for mutual TLS).
+func (c *Client) SetHTTPClient(httpClient *http.Client) {
+	c.httpClient = httpClient
+}
+
+// SetAuthenticator sets the authenticator used to add credentials to each service registry request.
+func (c *Client) SetAuthenticator(auth Authenticator) {
+	c.auth = auth
+}
+
+// do sends an authenticated request to the service registry.
+func (c *Client) do(method string, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	if c.auth != nil {
+		if err := c.auth.Authenticate(req, body); err != nil {
+			return nil, err
+		}
+	}
+
+	return c.httpClient.Do(req)
+}
+
+// SetBackoff sets the backoff policy used by WatchRegistry between registration retries.
+func (c *Client) SetBackoff(b Backoff) {
+	c.reqMux.Lock()
+	c.backoff = b
+	c.reqMux.Unlock()
+}
+
+// NotifyStatus registers a listener for registration attempts results.
+// The channel is never closed and results are dropped if the listener is
+// not ready to receive them, so a buffered channel is recommended.
+func (c *Client) NotifyStatus(ch chan RegistrationStatus) chan RegistrationStatus {
+	c.reqMux.Lock()
+	c.notify = append(c.notify, ch)
+	c.reqMux.Unlock()
+	return ch
+}
+
+// Status returns the result of the last registration attempt.
+func (c *Client) Status() RegistrationStatus {
+	c.reqMux.RLock()
+	defer c.reqMux.RUnlock()
+	return c.status
+}
+
+// Registered returns true if the service has been successfully registered.
+func (c *Client) Registered() bool {
+	c.reqMux.RLock()
+	defer c.reqMux.RUnlock()
+	return c.registered
+}
+
 // Register sends a service registration request to the SgulREG service.
-// TODO: add a channel to return results to the WatchRegistry() func.
+// Each attempt result is published to the listeners registered with NotifyStatus.
 func (c *Client) Register() (ServiceRegistrationResponse, error) {
-	c.reqMux.RLock()
+	return c.attempt(false)
+}
+
+// attempt sends a registration request and records the attempt result.
+// If retry is set, in MergeMode only the registries which did not accept
+// the registration yet are called.
+func (c *Client) attempt(retry bool) (ServiceRegistrationResponse, error) {
+	c.reqMux.Lock()
 	req := c.req
 	c.registered = false
-	c.reqMux.RUnlock()
+	attempt := c.status.Attempt + 1
+	c.reqMux.Unlock()
+
+	response, err := c.register(req, retry)
+	c.setStatus(RegistrationStatus{
+		Attempt:    attempt,
+		Registered: err == nil,
+		Response:   response,
+		Error:      errorString(err),
+		Timestamp:  time.Now(),
+	})
+
+	return response, err
+}
+
+// register sends the registration request to the registries according to the federation mode.
+// In FailoverMode it succeeds if one registry (the first reachable one) accepts the registration.
+// In MergeMode it succeeds only if all the registries accept it: on partial failures the response
+// of the first accepting registry is returned along with the error, and retries (retry set)
+// skip the registries which already accepted the registration.
+func (c *Client) register(req ServiceRegistrationRequest, retry bool) (ServiceRegistrationResponse, error) {
+	if len(c.registries) == 0 {
+		return ServiceRegistrationResponse{}, ErrNoRegistry
+	}
+
+	var registered *ServiceRegistrationResponse
+	var err error
+	failed := 0
+	for _, registry := range c.registries {
+		c.reqMux.RLock()
+		response, ok := c.registrations[registry.url]
+		c.reqMux.RUnlock()
+
+		if !retry || c.mode == FailoverMode || !ok {
+			var rerr error
+			if response, rerr = c.registerWith(registry, req); rerr != nil {
+				err = rerr
+				failed++
+				continue
+			}
+
+			c.reqMux.Lock()
+			c.registrations[registry.url] = response
+			c.reqMux.Unlock()
+		}
 
+		if registered == nil {
+			registered = &response
+		}
+		if c.mode == FailoverMode {
+			break
+		}
+	}
+
+	if registered == nil {
+		return ServiceRegistrationResponse{}, err
+	}
+	if c.mode == MergeMode && failed > 0 {
+		return *registered, fmt.Errorf("service registered with %d of %d registries: %s", len(c.registries)-failed, len(c.registries), err)
+	}
+	return *registered, nil
+}
+
+func (c *Client) registerWith(registry registryEndpoint, req ServiceRegistrationRequest) (ServiceRegistrationResponse, error) {
 	response := ServiceRegistrationResponse{}
 	jsonRequest, _ := json.Marshal(req)
-	resp, err := c.httpClient.Post(c.url, "application/json", bytes.NewBuffer(jsonRequest))
+	resp, err := c.do(http.MethodPost, registry.url, jsonRequest)
 	if err != nil {
 		return response, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return response, fmt.Errorf("service registry responded with status %d", resp.StatusCode)
+	}
+
 	var body []byte
 	body, err = ioutil.ReadAll(resp.Body)
 	json.Unmarshal(body, &response)
 
-	c.reqMux.RLock()
-	c.registered = true
-	c.reqMux.RUnlock()
-
 	return response, err
 }
 
+// setStatus records the last registration attempt result and notifies listeners.
+func (c *Client) setStatus(s RegistrationStatus) {
+	c.reqMux.Lock()
+	c.registered = s.Registered
+	if !s.Registered && c.watching {
+		s.NextRetry = c.backoff.Duration(s.Attempt)
+	}
+	if s.Registered {
+		// a successful registration resets the attempts count for the next cycle
+		s.Attempt = 0
+	}
+	c.status = s
+	listeners := c.notify
+	c.reqMux.Unlock()
+
+	for _, ch := range listeners {
+		select {
+		case ch <- s:
+		default:
+		}
+	}
+}
+
 // WatchRegistry start registration retries till the registration goes well.
+// Retries are spaced out using the client backoff policy and never overlap.
+// Only one watcher at a time is started for a client.
 func (c *Client) WatchRegistry() {
-	for !c.registered {
-		<-time.After(2 * time.Second)
-		if !c.registered {
-			go c.Register()
+	c.reqMux.Lock()
+	if c.watching {
+		c.reqMux.Unlock()
+		return
+	}
+	c.watching = true
+	stop := make(chan struct{})
+	c.stop = stop
+	c.reqMux.Unlock()
+
+	defer func() {
+		c.reqMux.Lock()
+		c.watching = false
+		c.stop = nil
+		c.reqMux.Unlock()
+	}()
+
+	for !c.Registered() {
+		c.reqMux.RLock()
+		wait := c.status.NextRetry
+		if wait == 0 {
+			wait = c.backoff.Duration(c.status.Attempt)
+		}
+		c.reqMux.RUnlock()
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+			c.attempt(true)
 		}
 	}
 }
 
+// StopWatching stops the registration retries started by WatchRegistry, if any.
+func (c *Client) StopWatching() {
+	c.reqMux.Lock()
+	defer c.reqMux.Unlock()
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
+}
+
+// Deregister removes the registered service instance from each SgulREG service
+// it was registered with. It stops any pending registration retry and does nothing
+// if the service was never registered.
+func (c *Client) Deregister() error {
+	c.StopWatching()
+
+	c.reqMux.RLock()
+	instanceIDs := make(map[string]string, len(c.registrations))
+	for url, registration := range c.registrations {
+		instanceIDs[url] = registration.InstanceID
+	}
+	c.reqMux.RUnlock()
+
+	var err error
+	for url, instanceID := range instanceIDs {
+		if derr := c.deregisterFrom(url, instanceID); derr != nil {
+			err = derr
+			continue
+		}
+		c.reqMux.Lock()
+		delete(c.registrations, url)
+		c.reqMux.Unlock()
+	}
+
+	if err == nil {
+		c.reqMux.Lock()
+		c.registered = false
+		c.status.Registered = false
+		c.reqMux.Unlock()
+	}
+
+	return err
+}
+
+func (c *Client) deregisterFrom(url string, instanceID string) error {
+	if instanceID == "" {
+		return nil
+	}
+
+	resp, err := c.do(http.MethodDelete, url+"/"+instanceID, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("service registry responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
 // DiscoverAll query the Service Registry to get all registered services information.
-// TODO: add WatchDiscoverAll()
+// In FailoverMode the first reachable registry response is returned, in MergeMode the
+// responses of all the reachable registries are merged.
+// Each instance is tagged with its origin registry.
 func (c *Client) DiscoverAll() ([]ServiceInfoResponse, error) {
-	resp, err := c.httpClient.Get(c.url)
+	services, _, err := c.discoverAll()
+	return services, err
+}
+
+// discoverAll queries the registries according to the federation mode, as DiscoverAll.
+// It also reports if the result is partial: in MergeMode, some registries did not respond.
+func (c *Client) discoverAll() ([]ServiceInfoResponse, bool, error) {
+	responses := [][]ServiceInfoResponse{}
+	partial := false
+	err := ErrNoRegistry
+	for _, registry := range c.registries {
+		response, derr := c.discoverFrom(registry)
+		if derr != nil {
+			err = derr
+			partial = c.mode == MergeMode
+			continue
+		}
+
+		responses = append(responses, response)
+		if c.mode == FailoverMode {
+			break
+		}
+	}
+
+	if len(responses) == 0 {
+		return []ServiceInfoResponse{}, false, err
+	}
+	return merge(responses...), partial, nil
+}
+
+func (c *Client) discoverFrom(registry registryEndpoint) ([]ServiceInfoResponse, error) {
+	resp, err := c.do(http.MethodGet, registry.url, nil)
+	if err != nil {
+		return []ServiceInfoResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return []ServiceInfoResponse{}, fmt.Errorf("service registry responded with status %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return []ServiceInfoResponse{}, err
 	}
 
 	response := []ServiceInfoResponse{}
-	var body []byte
-	body, err = ioutil.ReadAll(resp.Body)
-	json.Unmarshal(body, &response)
-	defer resp.Body.Close()
+	if err := json.Unmarshal(body, &response); err != nil {
+		return []ServiceInfoResponse{}, fmt.Errorf("invalid service registry response: %s", err)
+	}
+	tag(response, registry.origin)
 
-	return response, err
+	return response, nil
 }
 
 // WatchDiscoverAll call registry for all service discovery at regular intervals.
 // Makes this client local registry always fresh.
+//
+// Deprecated: use Watch to be notified of the services topology changes.
 func (c *Client) WatchDiscoverAll() {
 	for {
 		<-time.After(10 * time.Second)
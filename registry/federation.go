@@ -0,0 +1,97 @@
+package registry
+
+import (
+	"errors"
+	"strings"
+)
+
+// Mode is the way a federated client queries its service registries.
+type Mode int
+
+// Federation modes.
+const (
+	// FailoverMode queries registries in order, using the first one responding.
+	FailoverMode Mode = iota
+	// MergeMode queries all the registries and merges their responses.
+	MergeMode
+)
+
+// ErrNoRegistry is returned if the client has no service registry to query.
+var ErrNoRegistry = errors.New("no service registry configured")
+
+// registryEndpoint is a single service registry of a federation.
+type registryEndpoint struct {
+	// origin is the registry url as configured, used to tag discovered instances.
+	origin string
+	// url is the registry services API url.
+	url string
+}
+
+// ParseMode returns the federation mode by name ("failover" or "merge").
+// It defaults to FailoverMode.
+func ParseMode(mode string) Mode {
+	if strings.ToLower(mode) == "merge" {
+		return MergeMode
+	}
+	return FailoverMode
+}
+
+// String returns the federation mode name.
+func (m Mode) String() string {
+	if m == MergeMode {
+		return "merge"
+	}
+	return "failover"
+}
+
+// NewFederatedClient returns a new instance of the SgulREG API client bound to many
+// service registries (a.e. one for each datacenter).
+// In FailoverMode the first registry is the primary one and the others are used,
+// in order, only if the previous ones are unreachable. In MergeMode each registry is
+// queried and services are registered with all of them.
+// Discovered instances are tagged with their origin registry.
+func NewFederatedClient(mode Mode, registryURLs ...string) *Client {
+	c := NewClient("")
+	c.mode = mode
+	c.registries = make([]registryEndpoint, 0, len(registryURLs))
+	for _, u := range registryURLs {
+		c.registries = append(c.registries, registryEndpoint{origin: u, url: u + servicesPath})
+	}
+	return c
+}
+
+// tag sets the origin registry on each discovered instance.
+func tag(services []ServiceInfoResponse, origin string) {
+	for i := range services {
+		for j := range services[i].Instances {
+			services[i].Instances[j].Registry = origin
+		}
+	}
+}
+
+// merge merges discovered services by name. An instance registered with many registries
+// (same schema and host) is kept once, tagged with the first registry reporting it.
+func merge(responses ...[]ServiceInfoResponse) []ServiceInfoResponse {
+	merged := []ServiceInfoResponse{}
+	index := make(map[string]int)
+	seen := make(map[string]bool)
+	for _, services := range responses {
+		for _, service := range services {
+			i, ok := index[service.Name]
+			if !ok {
+				i = len(merged)
+				index[service.Name] = i
+				merged = append(merged, ServiceInfoResponse{Name: service.Name, Instances: []ServiceInstanceInfo{}})
+			}
+			for _, instance := range service.Instances {
+				endpoint := service.Name + " " + instance.Schema + "://" + instance.Host
+				if seen[endpoint] {
+					continue
+				}
+				seen[endpoint] = true
+				merged[i].Instances = append(merged[i].Instances, instance)
+			}
+		}
+	}
+	return merged
+}
@@ -28,6 +28,8 @@ type ServiceInstanceInfo struct {
 	HealthCheckURL        string    `json:"healthCheckUrl"`
 	RegistrationTimestamp time.Time `json:"registrationTimestamp"`
 	LastRefreshTimestamp  time.Time `json:"lastRefreshTimestamp"`
+	// Registry is the origin service registry of the instance (set by the client).
+	Registry string `json:"registry,omitempty"`
 }
 
 // ServiceInfoResponse defines the structure of the service instance response.
@@ -36,3 +38,14 @@ type ServiceInfoResponse struct {
 	Name      string                `json:"name"`
 	Instances []ServiceInstanceInfo `json:"instances"`
 }
+
+// RegistrationStatus reports the result of a single service registration attempt.
+type RegistrationStatus struct {
+	Attempt    int                         `json:"attempt"`
+	Registered bool                        `json:"registered"`
+	Response   ServiceRegistrationResponse `json:"response"`
+	Error      string                      `json:"error,omitempty"`
+	Timestamp  time.Time                   `json:"timestamp"`
+	// NextRetry is the wait time before the next attempt, if any.
+	NextRetry time.Duration `json:"nextRetry,omitempty"`
+}
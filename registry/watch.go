@@ -0,0 +1,159 @@
+package registry
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultWatchInterval is the default interval between two discovery
+// invocations for a registry watcher.
+const DefaultWatchInterval = 10 * time.Second
+
+// EventType is the type of a service registry topology change.
+type EventType int
+
+// Service registry event types.
+const (
+	InstanceAdded EventType = iota + 1
+	InstanceRemoved
+	InstanceUpdated
+)
+
+// String returns the event type name.
+func (t EventType) String() string {
+	switch t {
+	case InstanceAdded:
+		return "instance-added"
+	case InstanceRemoved:
+		return "instance-removed"
+	case InstanceUpdated:
+		return "instance-updated"
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes a change of a service instance in the service registry.
+type Event struct {
+	Type     EventType
+	Service  string
+	Instance ServiceInstanceInfo
+}
+
+// instances maps each watched service name to its instances, by origin registry and instance id.
+type instances map[string]map[string]ServiceInstanceInfo
+
+// SetWatchInterval sets the interval between two discovery invocations for registry watchers.
+func (c *Client) SetWatchInterval(interval time.Duration) {
+	c.reqMux.Lock()
+	c.watchInterval = interval
+	c.reqMux.Unlock()
+}
+
+// Watch subscribes to the topology changes of the named services (all services if none).
+// Events are computed from the diffs of successive discovery results: the first
+// discovery reports every already registered instance as added.
+// Failed (or, in MergeMode, partial) discoveries are skipped, so that an unavailable
+// registry does not report its instances as removed.
+// The returned channel is closed when the context is done.
+func (c *Client) Watch(ctx context.Context, names ...string) <-chan Event {
+	events := make(chan Event)
+
+	c.reqMux.RLock()
+	interval := c.watchInterval
+	c.reqMux.RUnlock()
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+
+	go func() {
+		defer close(events)
+
+		known := instances{}
+		for {
+			if services, partial, err := c.discoverAll(); err == nil && !partial {
+				current := snapshot(services, names)
+				for _, evt := range diff(known, current) {
+					select {
+					case events <- evt:
+					case <-ctx.Done():
+						return
+					}
+				}
+				known = current
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+
+	return events
+}
+
+// snapshot returns the instances of the named services (all services if no names).
+func snapshot(services []ServiceInfoResponse, names []string) instances {
+	s := instances{}
+	for _, service := range services {
+		if len(names) > 0 && !contains(names, service.Name) {
+			continue
+		}
+		s[service.Name] = make(map[string]ServiceInstanceInfo)
+		for _, instance := range service.Instances {
+			s[service.Name][instanceKey(instance)] = instance
+		}
+	}
+	return s
+}
+
+// diff returns the events needed to go from the previous to the current snapshot.
+func diff(previous instances, current instances) []Event {
+	events := []Event{}
+	for service, currentInstances := range current {
+		for id, instance := range currentInstances {
+			old, ok := previous[service][id]
+			if !ok {
+				events = append(events, Event{Type: InstanceAdded, Service: service, Instance: instance})
+			} else if changed(old, instance) {
+				events = append(events, Event{Type: InstanceUpdated, Service: service, Instance: instance})
+			}
+		}
+	}
+	for service, previousInstances := range previous {
+		for id, instance := range previousInstances {
+			if _, ok := current[service][id]; !ok {
+				events = append(events, Event{Type: InstanceRemoved, Service: service, Instance: instance})
+			}
+		}
+	}
+	return events
+}
+
+// instanceKey identifies an instance in a snapshot: instance ids are unique
+// within their origin registry only.
+func instanceKey(instance ServiceInstanceInfo) string {
+	return instance.Registry + " " + instance.InstanceID
+}
+
+// changed checks if an instance changed. The last refresh timestamp is
+// ignored since it changes on each instance heartbeat.
+func changed(old ServiceInstanceInfo, instance ServiceInstanceInfo) bool {
+	return old.Registry != instance.Registry ||
+		old.Host != instance.Host ||
+		old.Schema != instance.Schema ||
+		old.InfoURL != instance.InfoURL ||
+		old.HealthCheckURL != instance.HealthCheckURL ||
+		!old.RegistrationTimestamp.Equal(instance.RegistrationTimestamp)
+}
+
+func contains(s []string, elem string) bool {
+	for _, a := range s {
+		if a == elem {
+			return true
+		}
+	}
+	return false
+}
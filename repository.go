@@ -27,6 +27,8 @@ type GormRepository struct {
 type InTransaction func(tx *gorm.DB) error
 
 // DoInTransaction executes the fn() callback in a gorm transaction.
+// Events to be published only if the transaction commits can be
+// enqueued into the outbox with EnqueueEvent(tx, ...).
 func (r GormRepository) DoInTransaction(fn InTransaction) error {
 	tx := r.DB.Begin()
 	if tx.Error != nil {
@@ -9,32 +9,173 @@
 package sgul
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 
+	"github.com/go-chi/chi"
 	"github.com/itross/sgul/registry"
+	"github.com/itross/sgul/tlsconfig"
+)
+
+// Service registry authentication types.
+const (
+	RegistryBearerAuth = "bearer"
+	RegistryJWTAuth    = "jwt"
+	RegistryHMACAuth   = "hmac"
 )
 
 // REGAgent is the Agent used by a service to register its instance
 // with the SgulREG Service Registry.
 // It is an helper agent to use the sgulreg client.
 type REGAgent struct {
-	client *registry.Client
+	client     *registry.Client
+	onceSignal sync.Once
+}
+
+// DefaultHealthPath is the management health path used if none is configured.
+const DefaultHealthPath = "/health"
+
+// ErrMissingServiceName is returned if the self-registration request
+// cannot be built because of a missing service name in configuration.
+var ErrMissingServiceName = errors.New("missing service name in configuration")
+
+// serviceRegistryURLs returns the configured service registries urls: URL first, then the federated URLs.
+func serviceRegistryURLs(conf ServiceRegistry) []string {
+	urls := []string{}
+	if conf.URL != "" {
+		urls = append(urls, conf.URL)
+	}
+	return MergeStringSlices(urls, conf.URLs)
+}
+
+// getServiceRegistryURLs returns the configured service registries urls
+// or the default registry url if none is configured.
+func getServiceRegistryURLs() []string {
+	urls := []string{}
+	if IsSet("Client.ServiceRegistry") {
+		urls = serviceRegistryURLs(GetConfiguration().Client.ServiceRegistry)
+	}
+	if len(urls) == 0 {
+		return []string{registry.DefaultURL}
+	}
+	return urls
+}
+
+// getRegistrationBackoff returns the configured registration backoff policy:
+// unset values are taken from the registry default one.
+func getRegistrationBackoff() registry.Backoff {
+	if !IsSet("Client.ServiceRegistry.Backoff") {
+		return registry.DefaultBackoff
+	}
+	conf := GetConfiguration().Client.ServiceRegistry.Backoff
+	return registry.Backoff{
+		InitialInterval: conf.InitialInterval,
+		MaxInterval:     conf.MaxInterval,
+		Multiplier:      conf.Multiplier,
+		Jitter:          conf.Jitter,
+		NoJitter:        conf.NoJitter,
+	}.Merge(registry.DefaultBackoff)
+}
+
+// registryAuthenticator returns the service registry authenticator for the configured
+// authentication type, or nil if no authentication is configured.
+func registryAuthenticator(conf *Configuration) (registry.Authenticator, error) {
+	security := conf.Client.ServiceRegistry.Security
+	switch strings.ToLower(security.Auth) {
+	case "":
+		return nil, nil
+	case RegistryBearerAuth:
+		if security.Token == "" {
+			return nil, errors.New("missing token for service registry bearer authentication")
+		}
+		return &registry.BearerAuthenticator{Token: security.Token}, nil
+	case RegistryJWTAuth:
+		secret := security.Secret
+		if secret == "" {
+			secret = conf.API.Security.Jwt.Secret
+		}
+		if secret == "" {
+			return nil, errors.New("missing secret for service registry jwt authentication")
+		}
+		return &registry.JWTAuthenticator{Secret: []byte(secret), Subject: conf.Service.Name}, nil
+	case RegistryHMACAuth:
+		if security.Secret == "" {
+			return nil, errors.New("missing secret for service registry hmac authentication")
+		}
+		return &registry.HMACAuthenticator{KeyID: security.KeyID, Secret: []byte(security.Secret)}, nil
+	default:
+		return nil, fmt.Errorf("unknown service registry authentication type '%s'", security.Auth)
+	}
+}
+
+// registryHTTPClient returns the http client to call the service registry, with the
+// configured client timeouts (or the default ones) and configured for mutual TLS
+// if client certificate or CA are configured.
+func registryHTTPClient(conf *Configuration) (*http.Client, error) {
+	clientConf := defaultClientConfiguration
+	if IsSet("Client") {
+		clientConf = withDefaultTimeouts(conf.Client)
+	}
+	client := httpClient(clientConf)
+
+	tlsConf := conf.Client.ServiceRegistry.Security.TLS
+	if tlsConf.CertFile == "" && tlsConf.CAFile == "" && !tlsConf.InsecureSkipVerify {
+		return client, nil
+	}
+
+	tlsConfig, err := tlsconfig.New(tlsConf.CertFile, tlsConf.KeyFile, tlsConf.CAFile, tlsConf.InsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	client.Transport.(*http.Transport).TLSClientConfig = tlsConfig
+	return client, nil
 }
 
-func getServiceRegistryURL() string {
-	if !IsSet("Client.ServiceRegistry.URL") {
-		return registry.DefaultURL
+// newRegistryClient returns a registry client bound to the registries urls and configured
+// with the service registry configuration.
+// It panics if the service registry security configuration is not valid.
+func newRegistryClient(registryURLs ...string) *registry.Client {
+	conf := GetConfiguration()
+	client := registry.NewFederatedClient(registry.ParseMode(conf.Client.ServiceRegistry.Mode), registryURLs...)
+	client.SetBackoff(getRegistrationBackoff())
+	if interval := conf.Client.ServiceRegistry.WatchInterval; interval > 0 {
+		client.SetWatchInterval(interval)
+	}
+
+	httpClient, err := registryHTTPClient(conf)
+	if err != nil {
+		panic(fmt.Errorf("fatal error configuring service registry tls: %s", err))
+	}
+	client.SetHTTPClient(httpClient)
+
+	auth, err := registryAuthenticator(conf)
+	if err != nil {
+		panic(fmt.Errorf("fatal error configuring service registry authentication: %s", err))
 	}
-	return GetConfiguration().Client.ServiceRegistry.URL
+	client.SetAuthenticator(auth)
+
+	return client
 }
 
-// NewREGAgent returns a new REGAgent instance
+// NewREGAgent returns a new REGAgent instance.
+// If registerURL is empty, the agent is bound to the configured (federated) service registries.
 func NewREGAgent(registerURL string) *REGAgent {
 	if registerURL == "" {
-		registerURL = getServiceRegistryURL()
+		return &REGAgent{
+			client: newRegistryClient(getServiceRegistryURLs()...),
+		}
 	}
 	return &REGAgent{
-		client: registry.NewClient(registerURL),
+		client: newRegistryClient(registerURL),
 	}
 }
 
@@ -53,9 +194,102 @@ func (ra *REGAgent) Register(r registry.ServiceRegistrationRequest) (registry.Se
 	return response, err
 }
 
+// RegisterSelf builds the registration request from the service configuration
+// and registers this service instance with the SgulREG service.
+// Deregistration on SIGTERM or SIGINT is opt-in: it is enabled only by
+// Client.ServiceRegistry.Registration.DeregisterOnSignal. Otherwise the instance is not
+// deregistered on signals and the application must call Deregister on its own shutdown path.
+func (ra *REGAgent) RegisterSelf() (registry.ServiceRegistrationResponse, error) {
+	conf := GetConfiguration()
+	r, err := NewSelfRegistrationRequest(conf)
+	if err != nil {
+		return registry.ServiceRegistrationResponse{}, err
+	}
+
+	if conf.Client.ServiceRegistry.Registration.DeregisterOnSignal {
+		ra.onceSignal.Do(func() {
+			go ra.deregisterOnSignal(syscall.SIGTERM, os.Interrupt)
+		})
+	}
+
+	return ra.Register(r)
+}
+
+// Deregister removes this service instance from the SgulREG service.
+func (ra *REGAgent) Deregister() error {
+	return ra.client.Deregister()
+}
+
+// deregisterOnSignal waits for one of the signals and deregisters the service instance.
+// The signal is then raised again so that the default behaviour
+// (or any application handler) takes place.
+func (ra *REGAgent) deregisterOnSignal(signals ...os.Signal) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+	sig := <-ch
+	signal.Stop(ch)
+
+	if err := ra.Deregister(); err != nil {
+		log.Printf("service deregistration failed: %s", err)
+	} else {
+		log.Print("service deregistered")
+	}
+
+	if p, err := os.FindProcess(os.Getpid()); err == nil {
+		p.Signal(sig)
+	}
+}
+
+// NotifyStatus registers a listener for the registration attempts results.
+func (ra *REGAgent) NotifyStatus(ch chan registry.RegistrationStatus) chan registry.RegistrationStatus {
+	return ra.client.NotifyStatus(ch)
+}
+
+// Status returns the result of the last registration attempt.
+func (ra *REGAgent) Status() registry.RegistrationStatus {
+	return ra.client.Status()
+}
+
+// HealthHandler returns the http handler exposing the service registration state.
+// It is meant to be mounted on the management health endpoint (see MountHealth):
+// it responds 200 if the service is registered, 503 otherwise.
+func (ra *REGAgent) HealthHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := ra.client.Status()
+		body, err := json.Marshal(status)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if status.Registered {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write(body)
+	}
+}
+
+// MountHealth mounts the HealthHandler on the management router, at the configured
+// management health path (Management.Health.Path, DefaultHealthPath if not set).
+func (ra *REGAgent) MountHealth(r chi.Router) {
+	r.Get(healthPath(GetConfiguration().Management), ra.HealthHandler())
+}
+
+// healthPath returns the configured management health path, or DefaultHealthPath.
+// It is both the path the HealthHandler is mounted on and the advertised one.
+func healthPath(mgmt Management) string {
+	if mgmt.Health.Path == "" {
+		return DefaultHealthPath
+	}
+	return mgmt.Health.Path
+}
+
 // RegisterService is an helper to register a service with the SgulREG service.
 func RegisterService(r registry.ServiceRegistrationRequest) (registry.ServiceRegistrationResponse, error) {
-	regClient := registry.NewClient(getServiceRegistryURL())
+	regClient := newRegistryClient(getServiceRegistryURLs()...)
 	regClient.NewRequest(r)
 
 	response, err := regClient.Register()
@@ -67,3 +301,73 @@ func RegisterService(r registry.ServiceRegistrationRequest) (registry.ServiceReg
 
 	return response, err
 }
+
+// AutoRegister registers this service instance with the SgulREG service if
+// the self-registration is enabled in configuration (Client.ServiceRegistry.Registration.Auto).
+// It returns a nil agent if the self-registration is disabled: unless DeregisterOnSignal
+// is set, the returned agent Deregister method must be called on the application shutdown path.
+func AutoRegister() (*REGAgent, error) {
+	if !GetConfiguration().Client.ServiceRegistry.Registration.Auto {
+		return nil, nil
+	}
+
+	agent := NewREGAgent("")
+	if _, err := agent.RegisterSelf(); err != nil {
+		return agent, err
+	}
+	return agent, nil
+}
+
+// NewSelfRegistrationRequest builds the registration request for this service instance
+// from the Service, API and Management configuration.
+// The advertised host is the configured registration host, if set, otherwise
+// the first non-loopback IP address of the host.
+func NewSelfRegistrationRequest(conf *Configuration) (registry.ServiceRegistrationRequest, error) {
+	if conf.Service.Name == "" {
+		return registry.ServiceRegistrationRequest{}, ErrMissingServiceName
+	}
+
+	regConf := conf.Client.ServiceRegistry.Registration
+	schema := regConf.Schema
+	if schema == "" {
+		schema = "http"
+	}
+
+	host := regConf.Host
+	if host == "" {
+		var err error
+		if host, err = detectHost(); err != nil {
+			return registry.ServiceRegistrationRequest{}, err
+		}
+	}
+
+	infoPath := regConf.InfoPath
+	if infoPath == "" {
+		infoPath = "/info"
+	}
+
+	mgmt := conf.Management
+	mgmtURL := fmt.Sprintf("%s://%s:%d%s", schema, host, mgmt.Endpoint.Port, mgmt.Endpoint.BaseRoutingPath)
+
+	return registry.ServiceRegistrationRequest{
+		Name:           conf.Service.Name,
+		Host:           fmt.Sprintf("%s:%d", host, conf.API.Endpoint.Port),
+		Schema:         schema,
+		InfoURL:        mgmtURL + infoPath,
+		HealthCheckURL: mgmtURL + healthPath(mgmt),
+	}, nil
+}
+
+// detectHost returns the first non-loopback IPv4 address of the host,
+// falling back to the host name.
+func detectHost() (string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err == nil {
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+				return ipnet.IP.String(), nil
+			}
+		}
+	}
+	return os.Hostname()
+}
@@ -37,6 +37,8 @@ type ShamClient struct {
 	localRegistry   []string
 	lrMutex         *sync.RWMutex
 	serviceRegistry ServiceRegistry
+	registryClient  *http.Client
+	registryAuth    registry.Authenticator
 	logger          *Logger
 }
 
@@ -61,27 +63,68 @@ func clientConfiguration() Client {
 	if !IsSet("Client") {
 		return defaultClientConfiguration
 	}
-	return GetConfiguration().Client
+	return withDefaultTimeouts(GetConfiguration().Client)
+}
+
+// withDefaultTimeouts returns the client configuration with its unset (zero) timeouts
+// taken from the default client configuration.
+func withDefaultTimeouts(conf Client) Client {
+	if conf.Timeout <= 0 {
+		conf.Timeout = defaultClientConfiguration.Timeout
+	}
+	if conf.DialerTimeout <= 0 {
+		conf.DialerTimeout = defaultClientConfiguration.DialerTimeout
+	}
+	if conf.TLSHandshakeTimeout <= 0 {
+		conf.TLSHandshakeTimeout = defaultClientConfiguration.TLSHandshakeTimeout
+	}
+	if conf.ExpectContinueTimeout <= 0 {
+		conf.ExpectContinueTimeout = defaultClientConfiguration.ExpectContinueTimeout
+	}
+	if conf.ResponseHeaderTimeout <= 0 {
+		conf.ResponseHeaderTimeout = defaultClientConfiguration.ResponseHeaderTimeout
+	}
+	return conf
 }
 
 // httpClient initialize the internal http client structure with the incoming configuration.
 func httpClient(conf Client) *http.Client {
 	return &http.Client{
-		Transport: &http.Transport{
-			DialContext: (&net.Dialer{
-				Timeout: conf.DialerTimeout,
-			}).DialContext,
-			TLSHandshakeTimeout:   conf.TLSHandshakeTimeout,
-			ExpectContinueTimeout: conf.ExpectContinueTimeout,
-			ResponseHeaderTimeout: conf.ResponseHeaderTimeout,
-		},
-		Timeout: conf.Timeout,
+		Transport: httpTransport(conf),
+		Timeout:   conf.Timeout,
+	}
+}
+
+// httpTransport returns a new http transport set as the default one (proxy from environment,
+// idle connections pool) with the configured timeouts.
+func httpTransport(conf Client) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   conf.DialerTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   conf.TLSHandshakeTimeout,
+		ExpectContinueTimeout: conf.ExpectContinueTimeout,
+		ResponseHeaderTimeout: conf.ResponseHeaderTimeout,
 	}
 }
 
 // NewShamClient returns a new Sham client instance bounded to a service.
 func NewShamClient(serviceName string, apiPath string) *ShamClient {
 	clientConf := clientConfiguration()
+
+	registryClient, err := registryHTTPClient(GetConfiguration())
+	if err != nil {
+		panic(fmt.Errorf("fatal error configuring service registry tls: %s", err))
+	}
+	registryAuth, err := registryAuthenticator(GetConfiguration())
+	if err != nil {
+		panic(fmt.Errorf("fatal error configuring service registry authentication: %s", err))
+	}
+
 	sham := &ShamClient{
 		serviceName:     serviceName,
 		apiPath:         apiPath,
@@ -90,6 +133,8 @@ func NewShamClient(serviceName string, apiPath string) *ShamClient {
 		lrMutex:         &sync.RWMutex{},
 		localRegistry:   make([]string, 0),
 		serviceRegistry: clientConf.ServiceRegistry,
+		registryClient:  registryClient,
+		registryAuth:    registryAuth,
 		logger:          GetLogger(),
 	}
 
@@ -130,32 +175,46 @@ func (sc *ShamClient) fallbackDiscovery() {
 }
 
 // Discover gets service discovery information from the system service registry.
+// With federated service registries, registries are queried in order till the first
+// responding one ("failover" mode) or all of them are queried and their instances merged ("merge" mode).
 func (sc *ShamClient) discover() error {
 	sc.logger.Debugf("discovering endpoints for service %s", sc.serviceName)
-	response, err := sc.httpClient.Get(sc.serviceRegistry.URL + "/sgulreg/services/" + sc.serviceName)
-	if err != nil {
-		sc.logger.Errorf("Error making service discovery HTTP request: %s", err)
-		sc.fallbackDiscovery()
-		return ErrFailedDiscoveryRequest
+
+	var instances []registry.ServiceInstanceInfo
+	var err error
+	discovered := false
+	for _, url := range serviceRegistryURLs(sc.serviceRegistry) {
+		var serviceInfo registry.ServiceInfoResponse
+		if serviceInfo, err = sc.discoverFrom(url); err != nil {
+			continue
+		}
+
+		discovered = true
+		instances = append(instances, serviceInfo.Instances...)
+		if registry.ParseMode(sc.serviceRegistry.Mode) == registry.FailoverMode {
+			break
+		}
 	}
-	sc.logger.Debugf("discovery response content-length: %s", response.Header.Get("Content-length"))
 
-	body, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		sc.logger.Errorf("Error reading service discovery HTTP response body: %s", err)
+	if !discovered {
 		sc.fallbackDiscovery()
-		return ErrFailedDiscoveryResponseBody
+		if err == nil {
+			err = ErrFailedDiscoveryRequest
+		}
+		return err
 	}
-	defer response.Body.Close()
 
-	var serviceInfo registry.ServiceInfoResponse
-	json.Unmarshal([]byte(body), &serviceInfo)
-
-	if len(serviceInfo.Instances) > 0 {
+	if len(instances) > 0 {
 		var endpoints []string
-		for _, instance := range serviceInfo.Instances {
+		seen := make(map[string]bool)
+		for _, instance := range instances {
 			sc.logger.Debugf("discovered service %s endpoint serviceID: %s", sc.serviceName, instance.InstanceID)
 			endpoint := fmt.Sprintf("%s://%s%s", instance.Schema, instance.Host, sc.apiPath)
+			// the same instance can be registered with many (merged) registries
+			if seen[endpoint] {
+				continue
+			}
+			seen[endpoint] = true
 			endpoints = append(endpoints, endpoint)
 		}
 
@@ -172,3 +231,43 @@ func (sc *ShamClient) discover() error {
 
 	return nil
 }
+
+// discoverFrom gets service discovery information from a single service registry.
+func (sc *ShamClient) discoverFrom(registryURL string) (registry.ServiceInfoResponse, error) {
+	var serviceInfo registry.ServiceInfoResponse
+
+	request, err := http.NewRequest(http.MethodGet, registryURL+"/sgulreg/services/"+sc.serviceName, nil)
+	if err == nil && sc.registryAuth != nil {
+		err = sc.registryAuth.Authenticate(request, nil)
+	}
+	var response *http.Response
+	if err == nil {
+		response, err = sc.registryClient.Do(request)
+	}
+	if err != nil {
+		sc.logger.Errorf("Error making service discovery HTTP request to %s: %s", registryURL, err)
+		return serviceInfo, ErrFailedDiscoveryRequest
+	}
+	defer response.Body.Close()
+	sc.logger.Debugf("discovery response content-length: %s", response.Header.Get("Content-length"))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		sc.logger.Errorf("Service discovery HTTP request to %s responded with status %d", registryURL, response.StatusCode)
+		return serviceInfo, ErrFailedDiscoveryRequest
+	}
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		sc.logger.Errorf("Error reading service discovery HTTP response body from %s: %s", registryURL, err)
+		return serviceInfo, ErrFailedDiscoveryResponseBody
+	}
+
+	if err := json.Unmarshal(body, &serviceInfo); err != nil {
+		sc.logger.Errorf("Error decoding service discovery HTTP response body from %s: %s", registryURL, err)
+		return serviceInfo, ErrFailedDiscoveryResponseBody
+	}
+	for i := range serviceInfo.Instances {
+		serviceInfo.Instances[i].Registry = registryURL
+	}
+	return serviceInfo, nil
+}
@@ -0,0 +1,41 @@
+// Package tlsconfig defines the client tls configuration shared by the sgul clients
+// (a.e. the service registry client and the AMQP connection).
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+// ErrInvalidCAFile is returned if no certificate can be loaded from the CA file.
+var ErrInvalidCAFile = errors.New("no valid certificate found in CA file")
+
+// New returns the client tls configuration, for mutual TLS authentication
+// if the client certificate is set. Client certificate and CA file are optional.
+func New(certFile string, keyFile string, caFile string, insecureSkipVerify bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+
+	if certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, ErrInvalidCAFile
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,218 @@
+// Copyright 2019 Luca Stasio <joshuagame@gmail.com>
+// Copyright 2019 IT Resources s.r.l.
+//
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package sgul defines common structures and functionalities for applications.
+// transport.go defines the transport agnostic events publishing and subscribing interfaces.
+package sgul
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Events transports.
+const (
+	TransportAMQP   = "amqp"
+	TransportMemory = "memory"
+	TransportNATS   = "nats"
+	TransportRedis  = "redis"
+)
+
+// ErrTransportNotConnected is returned when publishing or subscribing on a transport not yet connected.
+var ErrTransportNotConnected = errors.New("events transport not connected")
+
+// Message headers used by transports with no content type, content encoding and message id properties.
+const (
+	headerContentType     = "content-type"
+	headerContentEncoding = "content-encoding"
+	headerMessageID       = "message-id"
+)
+
+type (
+	// EventPublisher publishes events.
+	EventPublisher interface {
+		Publish(event Event) error
+	}
+
+	// EventSubscriber passes the received events to its event handler.
+	EventSubscriber interface {
+		Handle(handler EventHandler)
+		Start() error
+		Stop() error
+	}
+
+	// EventTransport gives access to the configured publishers and subscribers,
+	// whatever the underlying transport is.
+	EventTransport interface {
+		Connect() error
+		EventPublisher(name string) (EventPublisher, error)
+		EventSubscriber(name string) (EventSubscriber, error)
+		Close() error
+	}
+)
+
+// NewEventTransport returns the events transport selected in configuration (Events.Transport):
+// "amqp" (default), "memory", "nats" or "redis". Publishers and subscribers are configured
+// in the AMQP configuration for all the transports.
+// The memory transport stands in for a broker in local tests; the NATS and Redis transports
+// can be tested against embedded servers (a.e. nats-server or miniredis).
+func NewEventTransport() (EventTransport, error) {
+	transport := GetConfiguration().Events.Transport
+	switch strings.ToLower(transport) {
+	case "", TransportAMQP:
+		return NewAMQPConnectionFromConfig(), nil
+	case TransportMemory:
+		bus, err := NewEventBus()
+		if err != nil {
+			return nil, err
+		}
+		return bus, nil
+	case TransportNATS:
+		nt, err := NewNATSTransport()
+		if err != nil {
+			return nil, err
+		}
+		return nt, nil
+	case TransportRedis:
+		rt, err := NewRedisTransport()
+		if err != nil {
+			return nil, err
+		}
+		return rt, nil
+	default:
+		return nil, fmt.Errorf("unknown events transport '%s'", transport)
+	}
+}
+
+// EventPublisher returns the "name"-publisher as an EventPublisher.
+func (conn *AMQPConnection) EventPublisher(name string) (EventPublisher, error) {
+	if pub := conn.publisher(name); pub != nil {
+		return pub, nil
+	}
+	pub, err := conn.NewPublisher(name)
+	if err != nil {
+		return nil, err
+	}
+	return pub, nil
+}
+
+// EventSubscriber returns the "name"-subscriber as an EventSubscriber.
+func (conn *AMQPConnection) EventSubscriber(name string) (EventSubscriber, error) {
+	if sub := conn.subscriber(name); sub != nil {
+		return sub, nil
+	}
+	sub, err := conn.NewSubscriber(name)
+	if err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// dispatchEvent upcasts the event and calls the event handler, through the deduplication store if any.
+func dispatchEvent(ctx context.Context, consumer string, dedup DedupStore, handler EventHandler, event Event) error {
+	event, err := Upcast(event)
+	if err != nil {
+		return err
+	}
+
+	if dedup == nil || event.ID == "" {
+		return handler(ctx, event)
+	}
+	return dedup.Process(ctx, consumer, event.ID, func(ctx context.Context) error {
+		return handler(ctx, event)
+	})
+}
+
+// retryDelay returns the delay before a retry: the last delay is used for further attempts.
+func retryDelay(delays []time.Duration, attempt int) time.Duration {
+	if len(delays) == 0 {
+		return DefaultRetryDelay
+	}
+	if attempt < len(delays) {
+		return delays[attempt]
+	}
+	return delays[len(delays)-1]
+}
+
+// encodeMessage encodes the event for transports with string headers,
+// returning the message headers and body.
+func encodeMessage(event Event, format string, contentType string, contentEncoding string) (map[string]string, []byte, error) {
+	if event.ID == "" {
+		event.ID = newUUID()
+	}
+
+	msg := amqp.Publishing{ContentType: contentType, ContentEncoding: contentEncoding}
+	if err := encodeEvent(format, event, &msg); err != nil {
+		return nil, nil, err
+	}
+
+	headers := map[string]string{headerMessageID: event.ID}
+	for k, v := range msg.Headers {
+		headers[k] = fmt.Sprint(v)
+	}
+	if msg.ContentType != "" {
+		headers[headerContentType] = msg.ContentType
+	}
+	if msg.ContentEncoding != "" {
+		headers[headerContentEncoding] = msg.ContentEncoding
+	}
+	return headers, msg.Body, nil
+}
+
+// decodeMessage decodes the event from a message received from transports with string headers.
+func decodeMessage(headers map[string]string, body []byte) (Event, error) {
+	d := amqp.Delivery{
+		ContentType:     headers[headerContentType],
+		ContentEncoding: headers[headerContentEncoding],
+		MessageId:       headers[headerMessageID],
+		Headers:         amqp.Table{},
+		Body:            body,
+	}
+	for k, v := range headers {
+		d.Headers[k] = v
+	}
+
+	event, err := decodeEvent(d)
+	if err != nil {
+		return Event{}, err
+	}
+	if event.ID == "" {
+		event.ID = d.MessageId
+	}
+	return event, nil
+}
+
+// headerRetryCount returns the number of retries in string headers.
+func headerRetryCount(headers map[string]string) int {
+	count, _ := strconv.Atoi(headers[HeaderRetryCount])
+	return count
+}
+
+// queueBindings returns the configured bindings of the queue.
+func queueBindings(conf AMQP, queue string) []Binding {
+	bindings := []Binding{}
+	for _, binding := range conf.Bindings {
+		if binding.Queue == queue {
+			bindings = append(bindings, binding)
+		}
+	}
+	return bindings
+}
+
+// exchangeTypes returns the configured exchanges types, by exchange name.
+func exchangeTypes(conf AMQP) map[string]string {
+	types := make(map[string]string, len(conf.Exchanges))
+	for _, exchange := range conf.Exchanges {
+		types[exchange.Name] = strings.ToLower(exchange.Type)
+	}
+	return types
+}
@@ -0,0 +1,73 @@
+// Copyright 2019 Luca Stasio <joshuagame@gmail.com>
+// Copyright 2019 IT Resources s.r.l.
+//
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package sgul defines common structures and functionalities for applications.
+// upcast.go defines the event upcasters chain, transforming older event versions to the current one.
+package sgul
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Upcaster transforms an event from a version to the next one.
+// It usually reshapes the generic event payload (a.e. a map decoded from json).
+type Upcaster func(event Event) (Event, error)
+
+var (
+	upcastersMu = &sync.RWMutex{}
+	// upcasters by event name and source version
+	upcasters = map[string]map[int]Upcaster{}
+)
+
+// RegisterUpcaster registers the upcaster transforming the "name"-event from version "from" to from+1.
+// Version 0 is the version of events published before the event was versioned.
+func RegisterUpcaster(name string, from int, upcaster Upcaster) {
+	upcastersMu.Lock()
+	defer upcastersMu.Unlock()
+	if upcasters[name] == nil {
+		upcasters[name] = map[int]Upcaster{}
+	}
+	upcasters[name][from] = upcaster
+}
+
+// CurrentVersion returns the current version of the "name"-event: the version after the last registered upcaster.
+func CurrentVersion(name string) int {
+	upcastersMu.RLock()
+	defer upcastersMu.RUnlock()
+	current := 0
+	for from := range upcasters[name] {
+		if from+1 > current {
+			current = from + 1
+		}
+	}
+	return current
+}
+
+// Upcast applies the upcasters chain registered for the event name to the event, from its
+// version up to the current one. Upcasting errors (and missing upcasters in the chain) are
+// returned as PayloadError, as the event will never be processed.
+func Upcast(event Event) (Event, error) {
+	name := event.Name
+	current := CurrentVersion(name)
+	for event.Version < current {
+		upcastersMu.RLock()
+		upcaster, ok := upcasters[name][event.Version]
+		upcastersMu.RUnlock()
+		if !ok {
+			return event, &PayloadError{Event: name, Err: fmt.Errorf("missing upcaster from version %d", event.Version)}
+		}
+
+		version := event.Version
+		upcasted, err := upcaster(event)
+		if err != nil {
+			return event, &PayloadError{Event: name, Err: fmt.Errorf("upcasting from version %d: %s", version, err)}
+		}
+		upcasted.Version = version + 1
+		event = upcasted
+	}
+	return event, nil
+}
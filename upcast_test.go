@@ -0,0 +1,176 @@
+// Copyright 2019 Luca Stasio <joshuagame@gmail.com>
+// Copyright 2019 IT Resources s.r.l.
+//
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package sgul
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+// splitCustomer upcasts OrderCreated from version 0 to 1: the customer name is split in first and last name.
+func splitCustomer(event Event) (Event, error) {
+	payload, ok := event.Payload.(map[string]interface{})
+	if !ok {
+		return event, errors.New("unexpected payload")
+	}
+	names := strings.SplitN(fmt.Sprint(payload["customer"]), " ", 2)
+	if len(names) != 2 {
+		return event, fmt.Errorf("invalid customer %v", payload["customer"])
+	}
+	payload["customerFirstName"], payload["customerLastName"] = names[0], names[1]
+	delete(payload, "customer")
+	return event, nil
+}
+
+// amountToCents upcasts OrderCreated from version 1 to 2: the decimal amount string becomes integer cents.
+func amountToCents(event Event) (Event, error) {
+	payload, ok := event.Payload.(map[string]interface{})
+	if !ok {
+		return event, errors.New("unexpected payload")
+	}
+	amount, err := strconv.ParseFloat(fmt.Sprint(payload["amount"]), 64)
+	if err != nil {
+		return event, err
+	}
+	payload["amountCents"] = int(math.Round(amount * 100))
+	delete(payload, "amount")
+	return event, nil
+}
+
+// loadEventFixture loads a recorded event from testdata/upcast.
+func loadEventFixture(t *testing.T, name string) Event {
+	t.Helper()
+	body, err := ioutil.ReadFile(filepath.Join("testdata", "upcast", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event Event
+	if err := json.Unmarshal(body, &event); err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+// normalize returns the json representation of v as generic values, to compare payloads.
+func normalize(t *testing.T, v interface{}) interface{} {
+	t.Helper()
+	body, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n interface{}
+	if err := json.Unmarshal(body, &n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestUpcast(t *testing.T) {
+	chain := map[int]Upcaster{0: splitCustomer, 1: amountToCents}
+
+	tests := []struct {
+		name        string
+		upcasters   map[int]Upcaster
+		fixture     string
+		want        string
+		wantVersion int
+		wantErr     bool
+	}{
+		{"v0 to current", chain, "order_created_v0.json", "order_created_v2.json", 2, false},
+		{"v1 to current", chain, "order_created_v1.json", "order_created_v2.json", 2, false},
+		{"current version", chain, "order_created_v2.json", "order_created_v2.json", 2, false},
+		{"unversioned event type", nil, "order_created_v0.json", "order_created_v0.json", 0, false},
+		{"missing step", map[int]Upcaster{1: amountToCents}, "order_created_v0.json", "", 0, true},
+		{"upcaster error", chain, "order_created_v1_bad_amount.json", "", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// each case has its own upcasters chain
+			name := "OrderCreated/" + tt.name
+			for from, upcaster := range tt.upcasters {
+				RegisterUpcaster(name, from, upcaster)
+			}
+
+			event := loadEventFixture(t, tt.fixture)
+			event.Name = name
+
+			got, err := Upcast(event)
+			if tt.wantErr {
+				if _, ok := err.(*PayloadError); !ok {
+					t.Fatalf("Upcast() error = %v, want a *PayloadError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Upcast() error = %v", err)
+			}
+
+			want := loadEventFixture(t, tt.want)
+			if got.Version != tt.wantVersion {
+				t.Errorf("Upcast() version = %d, want %d", got.Version, tt.wantVersion)
+			}
+			if got.ID != want.ID {
+				t.Errorf("Upcast() ID = %s, want %s", got.ID, want.ID)
+			}
+			if g, w := normalize(t, got.Payload), normalize(t, want.Payload); !reflect.DeepEqual(g, w) {
+				t.Errorf("Upcast() payload = %v, want %v", g, w)
+			}
+		})
+	}
+}
+
+func TestPublishedEventsCurrentVersion(t *testing.T) {
+	name := "OrderCreated/published"
+	RegisterUpcaster(name, 0, splitCustomer)
+	RegisterUpcaster(name, 1, amountToCents)
+
+	current := loadEventFixture(t, "order_created_v2.json").Payload
+
+	tests := []struct {
+		name  string
+		event Event
+	}{
+		{"new event", NewEvent(name, "orders", current)},
+		{"unversioned event", Event{ID: newUUID(), Name: name, Source: "orders", Payload: current}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := amqp.Publishing{ContentType: ContentTypeJSON}
+			if err := encodeEvent(EventFormatSgul, tt.event, &msg); err != nil {
+				t.Fatal(err)
+			}
+			event, err := decodeEvent(amqp.Delivery{ContentType: msg.ContentType, Body: msg.Body})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if event.Version != 2 {
+				t.Fatalf("published version = %d, want 2", event.Version)
+			}
+
+			// the current payload shape must not be upcasted again
+			got, err := Upcast(event)
+			if err != nil {
+				t.Fatalf("Upcast() error = %v", err)
+			}
+			if g, w := normalize(t, got.Payload), normalize(t, current); !reflect.DeepEqual(g, w) {
+				t.Errorf("Upcast() payload = %v, want %v", g, w)
+			}
+		})
+	}
+}
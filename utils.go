@@ -13,7 +13,9 @@ package sgul
 
 import (
 	"bytes"
+	"crypto/rand"
 	"fmt"
+	"time"
 
 	"github.com/fatih/structs"
 )
@@ -77,3 +79,15 @@ func MergeStringSlices(s1, s2 []string) []string {
 	mergedSlice := s1[:j]
 	return mergedSlice
 }
+
+// newUUID returns a new random (version 4) UUID string.
+func newUUID() string {
+	u := make([]byte, 16)
+	if _, err := rand.Read(u); err != nil {
+		// fallback to a time based unique string: should never happen
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+}